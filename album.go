@@ -0,0 +1,74 @@
+package bot
+
+import "time"
+
+// SetAlbumWindow groups incoming messages sharing a media_group_id into one
+// AlbumMessage. Items arriving within d of the first one are delivered
+// together, zero delivers every item as its own Message. It must be called
+// before Start.
+func (t *Telegram) SetAlbumWindow(d time.Duration) {
+	t.albumWindow = d
+}
+
+// pendingAlbum is an album waiting for the rest of its items
+type pendingAlbum struct {
+	album *AlbumMessage
+	timer *time.Timer
+}
+
+// bufferAlbum holds m until the album window of its group is over. Once the
+// bot is stopping m is delivered right away as its own Message.
+func (t *Telegram) bufferAlbum(m Message) {
+	t.albumMu.Lock()
+	if t.albumsClosed {
+		t.albumMu.Unlock()
+		t.publish(&m, m.ID)
+		return
+	}
+	defer t.albumMu.Unlock()
+
+	if pending, ok := t.albums[m.MediaGroupID]; ok {
+		pending.album.Messages = append(pending.album.Messages, m)
+		return
+	}
+
+	id := m.MediaGroupID
+	t.albums[id] = &pendingAlbum{
+		album: &AlbumMessage{
+			MediaGroupID: id,
+			Chat:         m.Chat,
+			Messages:     []Message{m},
+			ReceivedAt:   m.ReceivedAt,
+		},
+		timer: time.AfterFunc(t.albumWindow, func() {
+			t.flushAlbum(id)
+		}),
+	}
+}
+
+// flushAlbum delivers the buffered album to plugins
+func (t *Telegram) flushAlbum(id string) {
+	t.albumMu.Lock()
+	pending, ok := t.albums[id]
+	delete(t.albums, id)
+	t.albumMu.Unlock()
+
+	if ok {
+		t.publish(pending.album, id)
+	}
+}
+
+// flushAlbums stops the album timers and delivers every buffered album
+// without waiting for the rest of its items, it is called on Stop
+func (t *Telegram) flushAlbums() {
+	t.albumMu.Lock()
+	pending := t.albums
+	t.albums = make(map[string]*pendingAlbum)
+	t.albumsClosed = true
+	t.albumMu.Unlock()
+
+	for id, p := range pending {
+		p.timer.Stop()
+		t.publish(p.album, id)
+	}
+}
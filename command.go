@@ -0,0 +1,97 @@
+package bot
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+// meRetryInterval is how long username waits after getMe failed before
+// asking telegram again
+const meRetryInterval = time.Minute
+
+// ParseCommand splits a command message like "/start@mybot some args" into
+// cmd "start" and args "some args". ok is false when the text is not a
+// command or the command is addressed to a different bot. A message with
+// entities, and any incoming message, must start with a "bot_command" entity.
+func (t *Telegram) ParseCommand(m Message) (cmd string, args string, ok bool) {
+	cmd, target, args, ok := splitCommand(m)
+	if !ok {
+		return "", "", false
+	}
+	if target != "" {
+		// if the username is unknown, assume the command is for us
+		if username, ok := t.username(); ok && !strings.EqualFold(target, username) {
+			return "", "", false
+		}
+	}
+
+	return cmd, args, true
+}
+
+// setCommand sets Command of an incoming message that is a command for us
+func (t *Telegram) setCommand(m *Message) {
+	if cmd, _, ok := t.ParseCommand(*m); ok {
+		m.Command = cmd
+	}
+}
+
+// splitCommand splits the text of m into the command, the bot username it is
+// addressed to and args. Telegram marks every command it delivers with a
+// bot_command entity, text merely starting with a slash is not enough then.
+func splitCommand(m Message) (cmd, target, args string, ok bool) {
+	text := m.Text
+	if !strings.HasPrefix(text, "/") {
+		return "", "", "", false
+	}
+	if m.Entities != nil || !m.ReceivedAt.IsZero() {
+		if !startsWithCommand(m.Entities) {
+			return "", "", "", false
+		}
+	}
+
+	head := text
+	if i := strings.IndexFunc(text, unicode.IsSpace); i >= 0 {
+		head, args = text[:i], strings.TrimSpace(text[i:])
+	}
+	cmd = head[1:]
+	if at := strings.Index(cmd, "@"); at >= 0 {
+		cmd, target = cmd[:at], cmd[at+1:]
+	}
+	if cmd == "" {
+		return "", "", "", false
+	}
+
+	return cmd, target, args, true
+}
+
+// startsWithCommand reports whether there is a bot_command entity at the start
+func startsWithCommand(entities []Entity) bool {
+	for _, e := range entities {
+		if e.Type == "bot_command" && e.Offset == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// username returns the username of the bot, which Start resolves. It
+// only asks telegram when it is not known yet and getMe did not fail recently,
+// so a failing getMe isn't repeated for every command.
+func (t *Telegram) username() (string, bool) {
+	t.meMu.Lock()
+	me, failed := t.me, t.meFailed
+	t.meMu.Unlock()
+	if me != nil {
+		return me.Username, true
+	}
+	if !failed.IsZero() && time.Since(failed) < meRetryInterval {
+		return "", false
+	}
+
+	m, err := t.GetMe()
+	if err != nil {
+		return "", false
+	}
+	return m.Username, true
+}
@@ -0,0 +1,91 @@
+package bot
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsCommand(t *testing.T) {
+	tg := newTestTelegram(t, okHandler(nil))
+	tests := []struct {
+		name     string
+		text     string
+		entities []TMessageEntity
+		command  string
+	}{
+		{"start", "/start", []TMessageEntity{{Type: "bot_command", Offset: 0, Length: 6}}, "start"},
+		{"addressed", "/start@testbot now", []TMessageEntity{{Type: "bot_command", Offset: 0, Length: 14}}, "start"},
+		{"other bot", "/start@otherbot", []TMessageEntity{{Type: "bot_command", Offset: 0, Length: 15}}, ""},
+		{"no entities", "/help me", nil, ""},
+		{"mid text", "please /start", []TMessageEntity{{Type: "bot_command", Offset: 7, Length: 6}}, ""},
+		{"url", "see https://example.com/start", []TMessageEntity{{Type: "url", Offset: 4, Length: 25}}, ""},
+		{"path", "/usr/bin is #linux", []TMessageEntity{{Type: "hashtag", Offset: 12, Length: 6}}, ""},
+		{"slash only", "/ start", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMessage(TMessage{Text: tt.text, Entities: tt.entities}, json.RawMessage(nil), time.Now())
+			tg.setCommand(&m)
+			if got, want := m.IsCommand(), tt.command != ""; got != want {
+				t.Errorf("IsCommand() = %v, want %v", got, want)
+			}
+			if m.Command != tt.command {
+				t.Errorf("Command = %q, want %q", m.Command, tt.command)
+			}
+		})
+	}
+}
+
+func TestParseCommandGetMeFailed(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		failHandler("getMe", http.StatusInternalServerError, "Internal Server Error")(w, r)
+	})
+
+	for i := 0; i < 3; i++ {
+		// without the username the command is assumed to be for us
+		if cmd, _, ok := tg.ParseCommand(Message{Text: "/start@otherbot"}); !ok || cmd != "start" {
+			t.Errorf("ParseCommand = %q, %v, want start", cmd, ok)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("getMe called %d times, want once until meRetryInterval", calls)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tg := newTestTelegram(t, okHandler(nil))
+	tests := []struct {
+		text string
+		cmd  string
+		args string
+		ok   bool
+	}{
+		{"/start", "start", "", true},
+		{"/start@testbot", "start", "", true},
+		{"/start@TestBot extra  args ", "start", "extra  args", true},
+		{"/help\nmore", "help", "more", true},
+		{"/start@otherbot extra", "", "", false},
+		{"hello /start", "", "", false},
+		{"hello", "", "", false},
+		{"/", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			cmd, args, ok := tg.ParseCommand(Message{Text: tt.text})
+			if cmd != tt.cmd || args != tt.args || ok != tt.ok {
+				t.Errorf("ParseCommand(%q) = %q, %q, %v, want %q, %q, %v", tt.text, cmd, args, ok, tt.cmd, tt.args, tt.ok)
+			}
+		})
+	}
+}
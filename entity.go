@@ -0,0 +1,45 @@
+package bot
+
+import "unicode/utf8"
+
+// newEntities converts telegram entities, which are positioned in UTF-16
+// code units, to entities positioned in bytes of text
+func newEntities(text string, entities []TMessageEntity) []Entity {
+	if len(entities) == 0 {
+		return nil
+	}
+
+	out := make([]Entity, 0, len(entities))
+	for _, e := range entities {
+		start := utf16ToByteOffset(text, e.Offset)
+		end := utf16ToByteOffset(text, e.Offset+e.Length)
+		out = append(out, Entity{
+			Type:   e.Type,
+			Offset: start,
+			Length: end - start,
+			Text:   text[start:end],
+			URL:    e.URL,
+		})
+	}
+	return out
+}
+
+// utf16ToByteOffset returns byte index of text after n UTF-16 code units
+func utf16ToByteOffset(text string, n int) int {
+	units := 0
+	for i, r := range text {
+		if units >= n {
+			return i
+		}
+		units += utf16Len(r)
+	}
+	return len(text)
+}
+
+// utf16Len returns the number of UTF-16 code units encoding r
+func utf16Len(r rune) int {
+	if r >= 0x10000 && r <= utf8.MaxRune {
+		return 2 // surrogate pair
+	}
+	return 1
+}
@@ -0,0 +1,38 @@
+package bot
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestEntitiesUTF16Offsets(t *testing.T) {
+	// 😀 is 2 UTF-16 code units and 4 bytes, é is 1 code unit and 2 bytes
+	raw := `{"message_id":1,"chat":{"id":1,"type":"private"},"text":"😀 hé @ann #go https://go.dev",` +
+		`"entities":[{"type":"mention","offset":6,"length":4},{"type":"hashtag","offset":11,"length":3},{"type":"url","offset":15,"length":14}]}`
+	var m TMessage
+	if err := json.Unmarshal([]byte(raw), &m); err != nil {
+		t.Fatal(err)
+	}
+	message := newMessage(m, nil, time.Now())
+
+	want := []struct {
+		typ, text string
+	}{
+		{"mention", "@ann"},
+		{"hashtag", "#go"},
+		{"url", "https://go.dev"},
+	}
+	if len(message.Entities) != len(want) {
+		t.Fatalf("got %d entities, want %d", len(message.Entities), len(want))
+	}
+	for i, w := range want {
+		e := message.Entities[i]
+		if e.Type != w.typ || e.Text != w.text {
+			t.Errorf("entity %d = %s %q, want %s %q", i, e.Type, e.Text, w.typ, w.text)
+		}
+		if message.Text[e.Offset:e.Offset+e.Length] != e.Text {
+			t.Errorf("entity %d byte offsets don't match its text", i)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrMessageNotModified is returned when editing a message with the content
+// it already has
+var ErrMessageNotModified = errors.New("message is not modified")
+
+// ErrMessageCantBeDeleted is returned when deleting a message that is too old
+// (48 hours) or that the bot has no right to delete
+var ErrMessageCantBeDeleted = errors.New("message can't be deleted")
+
+// ErrNotEnoughRights is returned when the bot must be an administrator with
+// the appropriate rights to do the request
+var ErrNotEnoughRights = errors.New("not enough rights")
+
+// ErrMessageDiscarded is returned when an outgoing message was not sent
+// before its DiscardAfter
+var ErrMessageDiscarded = errors.New("message discarded")
+
+// ErrConflict is returned by Start when telegram refuses getUpdates because
+// another instance is polling with the same API key or a webhook is set
+var ErrConflict = errors.New("conflict with another getUpdates request")
+
+// ErrAlreadyStarted is returned by Start when the bot was started before, a
+// second poller would receive every update again
+var ErrAlreadyStarted = errors.New("bot already started")
+
+// ErrStopped is returned for a message that was still waiting for the rate
+// limit of telegram when the bot is stopped
+var ErrStopped = errors.New("bot stopped")
+
+// ErrInvalidFormat is returned for a message with unknown Format when strict
+// format is set, see SetStrictFormat
+var ErrInvalidFormat = errors.New("invalid message format")
+
+// ErrBotBlocked is returned when sending to a user who blocked the bot or to a
+// chat the bot was removed from
+var ErrBotBlocked = errors.New("bot was blocked or removed from the chat")
+
+// ErrTransient is returned when telegram responds with something other than
+// its json response, such as an HTML page of a bad gateway. The request may
+// succeed when it is retried later.
+var ErrTransient = errors.New("transient telegram error")
+
+// TelegramError is returned when telegram responds with ok false. Use
+// errors.As to inspect it:
+//
+//	var terr *TelegramError
+//	if errors.As(err, &terr) && terr.Code == 403 {
+//		// bot was blocked by the user
+//	}
+type TelegramError struct {
+	Code        int64
+	Description string
+}
+
+func (e *TelegramError) Error() string {
+	return fmt.Sprintf("code:%d description:%s", e.Code, e.Description)
+}
+
+// OpError is an error of background work received from Telegram.Errors, Op is
+// the telegram method such as "getUpdates" or "sendMessage", or "outbox" for
+// a message rejected before sending
+type OpError struct {
+	Op  string
+	Err error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error so errors.Is and errors.As see it
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// IsChatNotFound reports whether err is telegram refusing a request because
+// the chat does not exist or the bot has no access to it
+func IsChatNotFound(err error) bool {
+	var terr *TelegramError
+	return errors.As(err, &terr) && terr.Code == 400 && strings.Contains(terr.Description, "chat not found")
+}
+
+// rightsError returns ErrNotEnoughRights if telegram refused err because the
+// bot lacks admin rights, otherwise err itself
+func rightsError(err error) error {
+	var terr *TelegramError
+	if errors.As(err, &terr) && (strings.Contains(terr.Description, "not enough rights") || strings.Contains(terr.Description, "CHAT_ADMIN_REQUIRED")) {
+		return ErrNotEnoughRights
+	}
+	return err
+}
+
+// blockedError wraps err with ErrBotBlocked if telegram refused it because the
+// bot can no longer send to the chat, otherwise returns err itself
+func blockedError(err error) error {
+	var terr *TelegramError
+	if errors.As(err, &terr) && terr.Code == 403 {
+		return fmt.Errorf("%w: %s", ErrBotBlocked, terr.Description)
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTelegramError(t *testing.T) {
+	tg := newTestTelegram(t, failHandler("deleteMessage", 400, "Bad Request: chat not found"))
+
+	err := tg.DeleteMessage("404", 1)
+	var terr *TelegramError
+	if !errors.As(err, &terr) {
+		t.Fatalf("err = %v, want *TelegramError", err)
+	}
+	if terr.Code != 400 || terr.Description != "Bad Request: chat not found" {
+		t.Errorf("TelegramError = %+v", terr)
+	}
+	if !IsChatNotFound(err) {
+		t.Error("IsChatNotFound = false")
+	}
+
+	wrapped := fmt.Errorf("notify: %w", &TelegramError{Code: 403, Description: "Forbidden: bot was blocked by the user"})
+	if IsChatNotFound(wrapped) {
+		t.Error("IsChatNotFound = true for a 403")
+	}
+	if !errors.As(wrapped, &terr) || terr.Code != 403 {
+		t.Errorf("wrapped TelegramError = %+v", terr)
+	}
+}
+
+func TestErrorsChannel(t *testing.T) {
+	tg := newTestTelegram(t, failHandler("sendMessage", 400, "Bad Request: chat not found"))
+	tg.poolOutbox()
+	t.Cleanup(func() { tg.Stop(context.Background()) })
+
+	tg.output <- Message{Chat: Chat{ID: "404"}, Text: "hi"}
+	select {
+	case err := <-tg.Errors():
+		var oerr *OpError
+		if !errors.As(err, &oerr) || oerr.Op != "sendMessage" || !IsChatNotFound(err) {
+			t.Errorf("err = %v, want sendMessage chat not found", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error emitted for the failed send")
+	}
+}
+
+func TestErrorsChannelFull(t *testing.T) {
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < ErrorBufferSize+10; i++ {
+			tg.reportError("test", errors.New("boom"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reportError blocked on a full channel")
+	}
+	if len(tg.Errors()) != ErrorBufferSize {
+		t.Errorf("buffered %d errors, want %d", len(tg.Errors()), ErrorBufferSize)
+	}
+}
+
+const badGatewayPage = `<html>
+<head><title>502 Bad Gateway</title></head>
+<body><center><h1>502 Bad Gateway</h1></center><hr><center>nginx/1.18.0</center></body>
+</html>`
+
+func TestBadGatewayHTML(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "text/html")
+	rec.WriteHeader(http.StatusBadGateway)
+	rec.WriteString(badGatewayPage)
+
+	_, err := parseResponse(rec.Result())
+	if !errors.Is(err, ErrTransient) {
+		t.Fatalf("err = %v, want ErrTransient", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "http 502 text/html response is not json") {
+		t.Errorf("err = %q, want a clear message", msg)
+	}
+
+	// a send with retries left is attempted again
+	var calls int32
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(badGatewayPage))
+			return
+		}
+		okHandler(map[string]string{"sendMessage": `{"message_id":3,"chat":{"id":1}}`})(w, r)
+	})
+	tg.SetOutboxRateLimit(0, 0)
+	id, err := tg.SendMessage(Message{Chat: Chat{ID: "1"}, Text: "hi", Retry: 1})
+	if err != nil || id != 3 {
+		t.Errorf("got %d, %v, want the message sent on the second attempt", id, err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("sendMessage called %d times, want 2", n)
+	}
+}
@@ -12,7 +12,7 @@ import (
 // marcoPolo is an example plugin that will reply text marco with polo
 type marcoPolo struct {
 	in  chan interface{}
-	out chan bot.Message
+	out chan interface{}
 }
 
 func (*marcoPolo) Name() string {
@@ -23,7 +23,7 @@ func (*marcoPolo) Name() string {
 // input channel which is an inbox for new channel.
 // The reason 'in' is a return value so that plugin can specify the size
 // of the channel
-func (m *marcoPolo) Init(out chan bot.Message) (in chan interface{}, err error) {
+func (m *marcoPolo) Init(out chan interface{}) (in chan interface{}, err error) {
 	m.in = make(chan interface{}, 100)
 	m.out = out
 	go m.process()
@@ -51,11 +51,16 @@ func main() {
 	if key == "" {
 		panic("TELEGRAM_KEY can not be empty")
 	}
-	telegram := bot.NewTelegram(key)
+	telegram, err := bot.NewTelegram(key)
+	if err != nil {
+		panic(err)
+	}
 	plugin := marcoPolo{}
 	if err := telegram.AddPlugin(&plugin); err != nil {
 		panic(err)
 	}
 
-	telegram.Start()
+	if err := telegram.Start(); err != nil {
+		panic(err)
+	}
 }
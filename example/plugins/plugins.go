@@ -0,0 +1,52 @@
+// Package plugins has small example plugins to start a bot with or to use as
+// fixtures in tests.
+package plugins
+
+import "github.com/yulrizka/bot"
+
+// NoopPlugin receives every update and does nothing with it
+type NoopPlugin struct {
+	in chan interface{}
+}
+
+func (*NoopPlugin) Name() string {
+	return "Noop"
+}
+
+func (p *NoopPlugin) Init(out chan interface{}) (chan interface{}, error) {
+	p.in = make(chan interface{}, 100)
+	go func() {
+		for range p.in {
+		}
+	}()
+	return p.in, nil
+}
+
+// EchoPlugin replies every text message with the same text to the chat it
+// came from
+type EchoPlugin struct {
+	in  chan interface{}
+	out chan interface{}
+}
+
+func (*EchoPlugin) Name() string {
+	return "Echo"
+}
+
+func (p *EchoPlugin) Init(out chan interface{}) (chan interface{}, error) {
+	p.in = make(chan interface{}, 100)
+	p.out = out
+	go p.process()
+	return p.in, nil
+}
+
+func (p *EchoPlugin) process() {
+	for rawMsg := range p.in {
+		if message, ok := rawMsg.(*bot.Message); ok && message.Text != "" {
+			p.out <- bot.Message{
+				Chat: message.Chat,
+				Text: message.Text,
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package plugins
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/yulrizka/bot"
+	"github.com/yulrizka/bot/telegramtest"
+)
+
+func TestEchoPlugin(t *testing.T) {
+	srv := telegramtest.NewServer()
+	defer srv.Close()
+
+	telegram, err := bot.NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	telegram.SetHTTPClient(srv.Client())
+	if err := telegram.AddPlugin(&EchoPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := telegram.AddPlugin(&NoopPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- telegram.Start() }()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := telegram.Stop(ctx); err != nil {
+			t.Error(err)
+		}
+		<-done
+	}()
+
+	srv.AddMessage(42, "marco")
+	sent, err := srv.WaitSent(1, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent[0].Method != "sendMessage" || sent[0].Text("chat_id") != "42" || sent[0].Text("text") != "marco" {
+		t.Errorf("sent %s %s, want echo of marco to chat 42", sent[0].Method, sent[0].Body)
+	}
+}
@@ -0,0 +1,23 @@
+package bot
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LastSuccessfulPoll returns when getUpdates last succeeded, it is zero
+// before the first success
+func (t *Telegram) LastSuccessfulPoll() time.Time {
+	n := atomic.LoadInt64(&t.lastPoll)
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// Healthy reports whether getUpdates succeeded within maxAge, it can back a
+// liveness check. maxAge should be longer than the poll timeout.
+func (t *Telegram) Healthy(maxAge time.Duration) bool {
+	last := t.LastSuccessfulPoll()
+	return !last.IsZero() && time.Since(last) <= maxAge
+}
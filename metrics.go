@@ -0,0 +1,62 @@
+package bot
+
+import (
+	"net/http"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// stats are the metrics of a Telegram instance. updateLag is milliseconds
+// between a message was sent and it was received, a large lag means updates
+// are processed slower than they arrive or a backlog after downtime.
+type stats struct {
+	msgPerUpdateCount      metrics.Counter
+	updateCount            metrics.Counter
+	updateDuration         metrics.Timer
+	updateLatency          metrics.Timer
+	updateLag              metrics.Histogram
+	sendMessageDuration    metrics.Timer
+	msgTimeoutCount        metrics.Counter
+	msgFailedCount         metrics.Counter
+	msgDiscardedCount      metrics.Counter
+	msgDroppedCount        metrics.Counter
+	middlewareDroppedCount metrics.Counter
+	webhookRequestCount    metrics.Counter
+	updateMalformedCount   metrics.Counter
+}
+
+// newStats registers metrics to r, existing metrics with the same name are
+// reused so instances sharing a registry share the metrics
+func newStats(r metrics.Registry) *stats {
+	return &stats{
+		msgPerUpdateCount:      metrics.GetOrRegisterCounter("telegram.messagePerUpdate", r),
+		updateCount:            metrics.GetOrRegisterCounter("telegram.updates.count", r),
+		updateDuration:         metrics.GetOrRegisterTimer("telegram.updates.duration", r),
+		updateLatency:          metrics.GetOrRegisterTimer("telegram.getUpdates.latency", r),
+		updateLag:              metrics.GetOrRegisterHistogram("telegram.update.lag", r, metrics.NewExpDecaySample(1028, 0.015)),
+		sendMessageDuration:    metrics.GetOrRegisterTimer("telegram.sendMessage.duration", r),
+		msgTimeoutCount:        metrics.GetOrRegisterCounter("telegram.sendMessage.timeout", r),
+		msgFailedCount:         metrics.GetOrRegisterCounter("telegram.sendMessage.failed", r),
+		msgDiscardedCount:      metrics.GetOrRegisterCounter("telegram.sendMessage.discarded", r),
+		msgDroppedCount:        metrics.GetOrRegisterCounter("telegram.sendMessage.dropped", r),
+		middlewareDroppedCount: metrics.GetOrRegisterCounter("telegram.middleware.dropped", r),
+		webhookRequestCount:    metrics.GetOrRegisterCounter("telegram.webhook.request", r),
+		updateMalformedCount:   metrics.GetOrRegisterCounter("telegram.updates.malformed", r),
+	}
+}
+
+// SetMetricsRegistry sets where metrics of this instance are registered,
+// default is metrics.DefaultRegistry. It must be called before Start.
+func (t *Telegram) SetMetricsRegistry(r metrics.Registry) {
+	t.metrics = r
+	t.stats = newStats(r)
+}
+
+// MetricsHandler serves the metrics registry of this instance as JSON, mount
+// it on your own mux to scrape the telegram.* metrics
+func (t *Telegram) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		metrics.WriteJSONOnce(t.metrics, w)
+	})
+}
@@ -0,0 +1,192 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestUpdateLag(t *testing.T) {
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := metrics.NewRegistry()
+	tg.SetMetricsRegistry(registry)
+
+	now := time.Now()
+	raw := fmt.Sprintf(`{"message_id":1,"date":%d,"chat":{"id":5,"type":"private"},"text":"hi"}`, now.Add(-time.Hour).Unix())
+	tg.dispatchUpdate(TUpdate{UpdateID: 1, Message: []byte(raw)}, now)
+
+	lag := registry.Get("telegram.update.lag").(metrics.Histogram)
+	if lag.Count() != 1 {
+		t.Fatalf("lag count = %d, want 1", lag.Count())
+	}
+	if got := time.Duration(lag.Max()) * time.Millisecond; got < time.Hour || got > time.Hour+time.Second {
+		t.Errorf("lag = %s, want about an hour", got)
+	}
+}
+
+func TestUpdateTypeCount(t *testing.T) {
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := metrics.NewRegistry()
+	tg.SetMetricsRegistry(registry)
+
+	msg := []byte(`{"message_id":1,"chat":{"id":5,"type":"private"},"text":"hi"}`)
+	updates := []TUpdate{
+		{UpdateID: 1, Message: msg},
+		{UpdateID: 2, Message: msg},
+		{UpdateID: 3, EditedMessage: msg},
+		{UpdateID: 4, ChannelPost: msg},
+		{UpdateID: 5, CallbackQuery: &TCallbackQuery{ID: "q"}},
+		{UpdateID: 6},
+	}
+	for _, u := range updates {
+		tg.dispatchUpdate(u, time.Now())
+	}
+
+	want := map[string]int64{
+		"message":        2,
+		"edited_message": 1,
+		"channel_post":   1,
+		"callback_query": 1,
+		"unknown":        1,
+	}
+	for name, n := range want {
+		c, ok := registry.Get("telegram.updates.type." + name).(metrics.Counter)
+		if !ok {
+			t.Errorf("telegram.updates.type.%s not registered", name)
+			continue
+		}
+		if c.Count() != n {
+			t.Errorf("telegram.updates.type.%s = %d, want %d", name, c.Count(), n)
+		}
+	}
+	if registry.Get("telegram.updates.type.inline_query") != nil {
+		t.Error("telegram.updates.type.inline_query registered without inline queries")
+	}
+}
+
+func TestInputDroppedCount(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	registry := metrics.NewRegistry()
+	tg.SetMetricsRegistry(registry)
+	full := &testPlugin{name: "full", in: make(chan interface{}, 2)}
+	tg.AddPlugin(full)
+
+	for i := 1; i <= 5; i++ {
+		raw := fmt.Sprintf(`{"message_id":%d,"chat":{"id":1,"type":"private"},"text":"hi"}`, i)
+		tg.dispatchUpdate(TUpdate{UpdateID: int64(i), Message: []byte(raw)}, time.Now())
+	}
+
+	dropped, ok := registry.Get("telegram.input.dropped.full").(metrics.Counter)
+	if !ok {
+		t.Fatal("telegram.input.dropped.full not registered")
+	}
+	if dropped.Count() != 3 {
+		t.Errorf("dropped = %d, want 3", dropped.Count())
+	}
+}
+
+func TestSendLatency(t *testing.T) {
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		okHandler(map[string]string{"sendMessage": `{"message_id":1,"chat":{"id":1}}`})(w, r)
+	})
+	registry := metrics.NewRegistry()
+	tg.SetMetricsRegistry(registry)
+	tg.SetPollInterval(time.Second, 0)
+	startTestBot(t, tg)
+
+	if _, err := tg.SendMessage(Message{Chat: Chat{ID: "1"}, Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, name := range []string{"telegram.sendMessage.latency", "telegram.getUpdates.latency"} {
+		for {
+			timer, ok := registry.Get(name).(metrics.Timer)
+			if ok && timer.Count() > 0 {
+				if timer.Max() < int64(20*time.Millisecond) {
+					t.Errorf("%s = %s, want at least 20ms", name, time.Duration(timer.Max()))
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s was not recorded", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestMetricsRegistryPerInstance(t *testing.T) {
+	msg := []byte(`{"message_id":1,"from":{"id":7},"chat":{"id":5,"type":"private"},"text":"hi"}`)
+	newBot := func() (*Telegram, metrics.Registry) {
+		tg, err := NewTelegram("123:token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		registry := metrics.NewRegistry()
+		tg.SetMetricsRegistry(registry)
+		tg.Use(RateLimitMiddleware(1, registry))
+		tg.Use(func(Message) bool { return false })
+		return tg, registry
+	}
+	first, firstRegistry := newBot()
+	second, secondRegistry := newBot()
+
+	first.dispatchUpdate(TUpdate{UpdateID: 1, Message: msg}, time.Now())
+	first.dispatchUpdate(TUpdate{UpdateID: 2, Message: msg}, time.Now())
+	second.dispatchUpdate(TUpdate{UpdateID: 1, Message: msg}, time.Now())
+
+	for _, name := range []string{"telegram.updates.type.message", "telegram.middleware.dropped"} {
+		if got := firstRegistry.Get(name).(metrics.Counter).Count(); got != 2 {
+			t.Errorf("first %s = %d, want 2", name, got)
+		}
+		if got := secondRegistry.Get(name).(metrics.Counter).Count(); got != 1 {
+			t.Errorf("second %s = %d, want 1", name, got)
+		}
+	}
+	if got := firstRegistry.Get("telegram.input.rateLimited").(metrics.Counter).Count(); got != 1 {
+		t.Errorf("first telegram.input.rateLimited = %d, want 1", got)
+	}
+	if metrics.DefaultRegistry.Get("telegram.input.rateLimited") != nil {
+		t.Error("rate limit metric registered on the default registry")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg.SetMetricsRegistry(metrics.NewRegistry())
+	tg.dispatchUpdate(TUpdate{UpdateID: 1, Message: []byte(`{"message_id":1,"chat":{"id":5,"type":"private"},"text":"hi"}`)}, time.Now())
+
+	rec := httptest.NewRecorder()
+	tg.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var got map[string]map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %s: %v", rec.Body, err)
+	}
+	if _, ok := got["telegram.updates.count"]; !ok {
+		t.Error("telegram.updates.count missing from the JSON")
+	}
+	if got["telegram.updates.type.message"]["count"] != float64(1) {
+		t.Errorf("telegram.updates.type.message = %v", got["telegram.updates.type.message"])
+	}
+	if _, ok := got["telegram.sendMessage.duration"]; !ok {
+		t.Error("timers missing from the JSON")
+	}
+}
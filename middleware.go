@@ -0,0 +1,80 @@
+package bot
+
+// Middleware inspects incoming message before it is delivered to plugins,
+// returning false drops the message
+type Middleware func(Message) bool
+
+// Use adds middleware to the chain applied to incoming updates. Middlewares
+// run in the order they were added and the first one returning false stops
+// the chain. Use must be called before Start.
+func (t *Telegram) Use(mw Middleware) {
+	t.middlewares = append(t.middlewares, mw)
+}
+
+// allow runs the middleware chain on msg
+func (t *Telegram) allow(msg interface{}) bool {
+	if len(t.middlewares) == 0 {
+		return true
+	}
+
+	m, ok := messageOf(msg)
+	if !ok {
+		return true
+	}
+	for _, mw := range t.middlewares {
+		if !mw(m) {
+			t.stats.middlewareDroppedCount.Inc(1)
+			return false
+		}
+	}
+	return true
+}
+
+// messageOf returns the Message middleware sees for an update. For callback
+// query it is the user pressing the button with Data as Text, for inline query
+// it is the user with Query as Text, for poll answer it is the voter and for
+// bot chat member update it is the user changing the status. For album it is
+// the first item.
+func messageOf(msg interface{}) (Message, bool) {
+	switch msg := msg.(type) {
+	case *Message:
+		return *msg, true
+	case *EditedMessage:
+		return msg.Message, true
+	case *ChannelMigratedMessage:
+		return msg.Message, true
+	case *ChatMemberJoinedMessage:
+		return msg.Message, true
+	case *ChatMemberLeftMessage:
+		return msg.Message, true
+	case *AlbumMessage:
+		if len(msg.Messages) > 0 {
+			return msg.Messages[0], true
+		}
+	case *CallbackQuery:
+		m := Message{
+			ID:         msg.ID,
+			From:       msg.From,
+			Text:       msg.Data,
+			ReceivedAt: msg.ReceivedAt,
+		}
+		if msg.Message != nil {
+			m.Chat = msg.Message.Chat
+		}
+		return m, true
+	case *InlineQuery:
+		return Message{ID: msg.ID, From: msg.From, Text: msg.Query, ReceivedAt: msg.ReceivedAt}, true
+	case *BotChatMemberUpdate:
+		return Message{From: msg.From, Chat: msg.Chat, Date: msg.Date, ReceivedAt: msg.ReceivedAt}, true
+	case *PollAnswer:
+		return Message{ID: msg.PollID, From: msg.User, ReceivedAt: msg.ReceivedAt}, true
+	}
+	return Message{}, false
+}
+
+// IgnoreBotsMiddleware drops messages sent by bots
+func IgnoreBotsMiddleware() Middleware {
+	return func(m Message) bool {
+		return !m.From.IsBot
+	}
+}
@@ -0,0 +1,103 @@
+package bot
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// dispatchText dispatches a private text message from user fromID
+func dispatchText(tg *Telegram, id int, fromID int64, text string) {
+	raw := fmt.Sprintf(`{"message_id":%d,"from":{"id":%d,"first_name":"u"},"chat":{"id":%d,"type":"private"},"text":%q}`, id, fromID, fromID, text)
+	tg.dispatchUpdate(TUpdate{UpdateID: int64(id), Message: []byte(raw)}, time.Now())
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	var calls []string
+	tg.Use(func(m Message) bool {
+		calls = append(calls, "block:"+m.Text)
+		return m.From.ID != "666"
+	})
+	tg.Use(func(m Message) bool {
+		calls = append(calls, "log:"+m.Text)
+		return true
+	})
+
+	dispatchText(tg, 1, 666, "spam")
+	dispatchText(tg, 2, 7, "hello")
+
+	if m := p.next(t).(*Message); m.Text != "hello" {
+		t.Errorf("delivered %q, want only hello", m.Text)
+	}
+	p.noUpdate(t, 10*time.Millisecond)
+	want := "[block:spam block:hello log:hello]"
+	if got := fmt.Sprint(calls); got != want {
+		t.Errorf("middleware calls = %s, want %s", got, want)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	registry := metrics.NewRegistry()
+	allow := RateLimitMiddleware(5, registry)
+	passed := 0
+	for i := 0; i < 10; i++ {
+		if allow(Message{From: User{ID: "7"}}) {
+			passed++
+		}
+	}
+	if passed != 5 {
+		t.Errorf("%d of 10 messages passed, want 5", passed)
+	}
+	if n := registry.Get("telegram.input.rateLimited").(metrics.Counter).Count(); n != 5 {
+		t.Errorf("telegram.input.rateLimited = %d, want 5", n)
+	}
+	if !allow(Message{From: User{ID: "8"}}) {
+		t.Error("another user was limited")
+	}
+
+	// channel posts and anonymous admins have no sender
+	for i := 0; i < 10; i++ {
+		if !allow(Message{Chat: Chat{ID: "-100"}}) {
+			t.Fatalf("message without sender %d was limited", i)
+		}
+	}
+
+	unlimited := RateLimitMiddleware(0, nil)
+	for i := 0; i < 10; i++ {
+		if !unlimited(Message{From: User{ID: "7"}}) {
+			t.Fatalf("message %d limited with perMinute 0", i)
+		}
+	}
+}
+
+func TestIgnoreBotsMiddleware(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+	tg.Use(IgnoreBotsMiddleware())
+
+	bot := `{"message_id":1,"from":{"id":9,"is_bot":true,"first_name":"spam"},"chat":{"id":-100,"type":"group"},"text":"buy now"}`
+	tg.dispatchUpdate(TUpdate{UpdateID: 1, Message: []byte(bot)}, time.Now())
+	dispatchText(tg, 2, 42, "hello")
+
+	m, ok := p.next(t).(*Message)
+	if !ok || m.Text != "hello" || m.From.IsBot {
+		t.Errorf("got %+v, want the human message only", m)
+	}
+	p.noUpdate(t, 50*time.Millisecond)
+
+	// the flag is parsed when no middleware drops it
+	tg, _ = NewTelegram("123:token")
+	p = newTestPlugin("p")
+	tg.AddPlugin(p)
+	tg.dispatchUpdate(TUpdate{UpdateID: 1, Message: []byte(bot)}, time.Now())
+	if m, ok := p.next(t).(*Message); !ok || !m.From.IsBot {
+		t.Errorf("got %+v, want From.IsBot", m)
+	}
+}
@@ -0,0 +1,207 @@
+package bot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// ErrEmptyFile is returned when uploading a file without content or name
+var ErrEmptyFile = errors.New("file is empty")
+
+// FileOrID is a file to send, either one telegram already has referred by
+// file_id or URL, or content uploaded from Reader
+type FileOrID struct {
+	ID       string
+	Filename string
+	Reader   io.Reader
+}
+
+// FileID refers to a file by its file_id or URL
+func FileID(id string) FileOrID {
+	return FileOrID{ID: id}
+}
+
+// FileReader uploads content of r as a file named filename
+func FileReader(filename string, r io.Reader) FileOrID {
+	return FileOrID{Filename: filename, Reader: r}
+}
+
+// multipartFile is file uploaded as part of multipart request
+type multipartFile struct {
+	field    string
+	filename string
+	r        io.Reader
+}
+
+// newMultipart encodes fields and file as multipart/form-data body and
+// returns it with its content type. The file is skipped when it has no reader.
+func newMultipart(fields map[string]string, file multipartFile) (*bytes.Buffer, string, error) {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if fields[k] == "" {
+			continue
+		}
+		if err := w.WriteField(k, fields[k]); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if file.r != nil {
+		part, err := w.CreateFormFile(file.field, file.filename)
+		if err != nil {
+			return nil, "", err
+		}
+		n, err := io.Copy(part, file.r)
+		if err != nil {
+			return nil, "", err
+		}
+		if n == 0 {
+			return nil, "", ErrEmptyFile
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return &b, w.FormDataContentType(), nil
+}
+
+// callMultipart uploads file with fields to telegram method
+func (t *Telegram) callMultipart(method string, fields map[string]string, file multipartFile) (TResponse, error) {
+	body, contentType, err := newMultipart(fields, file)
+	if err != nil {
+		return TResponse{}, err
+	}
+
+	resp, err := t.client.Post(fmt.Sprintf("%s/%s", t.url, method), contentType, body)
+	if err != nil {
+		return TResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	return parseResponse(resp)
+}
+
+// SendDocument uploads content of r as a file named filename to a chat
+func (t *Telegram) SendDocument(chatID string, filename string, r io.Reader, caption string) error {
+	// without a reader the document part would be left out of the request
+	if r == nil || filename == "" {
+		return ErrEmptyFile
+	}
+	fields := map[string]string{
+		"chat_id": chatID,
+		"caption": caption,
+	}
+	file := multipartFile{field: "document", filename: filename, r: r}
+	if _, err := t.callMultipart("sendDocument", fields, file); err != nil {
+		t.log.Error("sendDocument failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// sendFile sends f as field of method, it is uploaded when it has a reader
+func (t *Telegram) sendFile(method, field string, fields map[string]string, f FileOrID) (TResponse, error) {
+	file := multipartFile{field: field, filename: f.Filename, r: f.Reader}
+	if f.Reader == nil {
+		fields[field] = f.ID
+	}
+	return t.callMultipart(method, fields, file)
+}
+
+// VoiceOptions are optional fields of a voice message
+type VoiceOptions struct {
+	Caption        string
+	Duration       time.Duration
+	ProtectContent bool
+}
+
+// SendVoice sends an OGG/OPUS audio shown as a playable voice message
+func (t *Telegram) SendVoice(chatID string, voice FileOrID, opts VoiceOptions) error {
+	fields := map[string]string{
+		"chat_id":         chatID,
+		"caption":         opts.Caption,
+		"duration":        durationField(opts.Duration),
+		"protect_content": boolField(opts.ProtectContent),
+	}
+	if _, err := t.sendFile("sendVoice", "voice", fields, voice); err != nil {
+		t.log.Error("sendVoice failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// AudioOptions are optional fields of an audio message
+type AudioOptions struct {
+	Caption        string
+	Duration       time.Duration
+	Title          string
+	Performer      string
+	ProtectContent bool
+}
+
+// SendAudio sends an MP3 or M4A audio shown in the music player
+func (t *Telegram) SendAudio(chatID string, audio FileOrID, opts AudioOptions) error {
+	fields := map[string]string{
+		"chat_id":         chatID,
+		"caption":         opts.Caption,
+		"duration":        durationField(opts.Duration),
+		"title":           opts.Title,
+		"performer":       opts.Performer,
+		"protect_content": boolField(opts.ProtectContent),
+	}
+	if _, err := t.sendFile("sendAudio", "audio", fields, audio); err != nil {
+		t.log.Error("sendAudio failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// SendVideo sends an MP4 video with optional caption
+func (t *Telegram) SendVideo(chatID string, video FileOrID, caption string) error {
+	fields := map[string]string{
+		"chat_id": chatID,
+		"caption": caption,
+	}
+	if _, err := t.sendFile("sendVideo", "video", fields, video); err != nil {
+		t.log.Error("sendVideo failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// durationField formats d as seconds, zero is left empty so it is not sent
+func durationField(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64(d/time.Second), 10)
+}
+
+// boolField formats b, false is left empty so it is not sent
+func boolField(b bool) string {
+	if !b {
+		return ""
+	}
+	return "true"
+}
@@ -0,0 +1,130 @@
+package bot
+
+import (
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// multipartHandler records form values of multipart requests by method
+func multipartHandler(t *testing.T, got map[string]map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("parsing multipart: %v", err)
+		}
+		method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		values := make(map[string]string)
+		for k, v := range r.MultipartForm.Value {
+			values[k] = v[0]
+		}
+		for k, files := range r.MultipartForm.File {
+			values[k] = "file:" + files[0].Filename
+		}
+		got[method] = values
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
+	}
+}
+
+func TestSendDocument(t *testing.T) {
+	var contentType, content string
+	requests := 0
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		contentType = r.Header.Get("Content-Type")
+		_, params, _ := mime.ParseMediaType(contentType)
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			b, _ := ioutil.ReadAll(part)
+			if part.FormName() == "document" {
+				content = part.FileName() + ":" + string(b)
+			}
+		}
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
+	})
+
+	if err := tg.SendDocument("1", "report.txt", strings.NewReader("all good"), "daily"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(contentType, "multipart/form-data; boundary=") {
+		t.Errorf("Content-Type = %q", contentType)
+	}
+	if content != "report.txt:all good" {
+		t.Errorf("document part = %q, want report.txt:all good", content)
+	}
+
+	if err := tg.SendDocument("1", "empty.txt", strings.NewReader(""), ""); !errors.Is(err, ErrEmptyFile) {
+		t.Errorf("empty document err = %v, want ErrEmptyFile", err)
+	}
+
+	requests = 0
+	if err := tg.SendDocument("1", "report.txt", nil, ""); !errors.Is(err, ErrEmptyFile) {
+		t.Errorf("nil reader err = %v, want ErrEmptyFile", err)
+	}
+	if err := tg.SendDocument("1", "", strings.NewReader("all good"), ""); !errors.Is(err, ErrEmptyFile) {
+		t.Errorf("empty filename err = %v, want ErrEmptyFile", err)
+	}
+	if requests != 0 {
+		t.Errorf("%d requests sent for documents without reader or filename", requests)
+	}
+}
+
+func TestSendVoiceAndAudio(t *testing.T) {
+	got := make(map[string]map[string]string)
+	tg := newTestTelegram(t, multipartHandler(t, got))
+
+	if err := tg.SendVoice("1", FileReader("note.ogg", strings.NewReader("ogg")), VoiceOptions{Caption: "listen", Duration: 3 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	voice := got["sendVoice"]
+	if voice["voice"] != "file:note.ogg" || voice["caption"] != "listen" || voice["duration"] != "3" {
+		t.Errorf("sendVoice = %v", voice)
+	}
+
+	opts := AudioOptions{Caption: "new single", Title: "Song", Performer: "Band"}
+	if err := tg.SendAudio("1", FileID("https://example.com/song.mp3"), opts); err != nil {
+		t.Fatal(err)
+	}
+	audio := got["sendAudio"]
+	if audio["audio"] != "https://example.com/song.mp3" || audio["caption"] != "new single" || audio["title"] != "Song" || audio["performer"] != "Band" {
+		t.Errorf("sendAudio = %v", audio)
+	}
+}
+
+func TestSendVideo(t *testing.T) {
+	got := make(map[string]map[string]string)
+	tg := newTestTelegram(t, multipartHandler(t, got))
+
+	if err := tg.SendVideo("1", FileID("video-file-id"), "clip"); err != nil {
+		t.Fatal(err)
+	}
+	if v := got["sendVideo"]; v["chat_id"] != "1" || v["video"] != "video-file-id" || v["caption"] != "clip" {
+		t.Errorf("sendVideo = %v", v)
+	}
+}
+
+func TestSendVoiceProtectContent(t *testing.T) {
+	got := make(map[string]map[string]string)
+	tg := newTestTelegram(t, multipartHandler(t, got))
+
+	if err := tg.SendVoice("1", FileID("voice"), VoiceOptions{ProtectContent: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got["sendVoice"]["protect_content"] != "true" {
+		t.Errorf("protect_content = %q, want true", got["sendVoice"]["protect_content"])
+	}
+	if err := tg.SendAudio("1", FileID("audio"), AudioOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got["sendAudio"]["protect_content"]; ok {
+		t.Error("protect_content sent when false")
+	}
+}
@@ -0,0 +1,59 @@
+package bot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// OffsetStore persists id of the last processed update so that polling can
+// continue where it stopped after restart
+type OffsetStore interface {
+	Load() (int64, error)
+	Save(int64) error
+}
+
+// FileOffsetStore is OffsetStore that keeps the offset in a file
+type FileOffsetStore struct {
+	path string
+}
+
+// NewFileOffsetStore creates OffsetStore backed by file at path
+func NewFileOffsetStore(path string) *FileOffsetStore {
+	return &FileOffsetStore{path: path}
+}
+
+// Load returns stored offset, 0 when nothing has been saved yet
+func (s *FileOffsetStore) Load() (int64, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// Save replaces stored offset
+func (s *FileOffsetStore) Save(offset int64) error {
+	// write to temp file then rename so a crash never leaves a partial file
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strconv.FormatInt(offset, 10)); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path)
+}
@@ -0,0 +1,78 @@
+package bot
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memOffsetStore is OffsetStore keeping the offset in memory
+type memOffsetStore struct {
+	mu     sync.Mutex
+	offset int64
+}
+
+func (s *memOffsetStore) Load() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.offset, nil
+}
+
+func (s *memOffsetStore) Save(offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset = offset
+	return nil
+}
+
+func TestOffsetStore(t *testing.T) {
+	offsets := make(chan string, 100)
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/getUpdates") {
+			offset := r.URL.Query().Get("offset")
+			select {
+			case offsets <- offset:
+			default:
+			}
+			if offset == "42" {
+				w.Write([]byte(`{"ok":true,"result":[{"update_id":50,"message":{"message_id":1,"chat":{"id":1,"type":"private"},"text":"hi"}}]}`))
+				return
+			}
+		}
+		okHandler(nil)(w, r)
+	})
+	store := &memOffsetStore{offset: 41}
+	tg.SetOffsetStore(store)
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+	startTestBot(t, tg)
+
+	if got := <-offsets; got != "42" {
+		t.Fatalf("first offset = %s, want 42 from the store", got)
+	}
+	p.next(t)
+	if got := <-offsets; got != "51" {
+		t.Errorf("next offset = %s, want 51", got)
+	}
+	if got, _ := store.Load(); got != 50 {
+		t.Errorf("saved offset = %d, want 50", got)
+	}
+}
+
+func TestFileOffsetStore(t *testing.T) {
+	store := NewFileOffsetStore(filepath.Join(t.TempDir(), "offset"))
+	if got, err := store.Load(); err != nil || got != 0 {
+		t.Fatalf("Load() before Save = %d, %v, want 0", got, err)
+	}
+	if err := store.Save(1234); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(5678); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Load(); err != nil || got != 5678 {
+		t.Errorf("Load() = %d, %v, want 5678", got, err)
+	}
+}
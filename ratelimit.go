@@ -0,0 +1,203 @@
+package bot
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// tokenBucket allows bursts up to capacity and refills at rate tokens per
+// second
+type tokenBucket struct {
+	capacity float64
+	rate     float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(capacity int, rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		capacity: float64(capacity),
+		rate:     rate,
+		tokens:   float64(capacity),
+		last:     now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+}
+
+// take consumes a token, it returns false when the bucket is empty
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// wait returns how long until a token is available
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled completely
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.capacity
+}
+
+// Default outgoing limits, telegram allows about 30 messages per second
+// overall and 1 per second to the same chat
+const (
+	defaultOutboxRate    = 30
+	defaultOutboxPerChat = 1
+)
+
+// outboxLimiter paces outgoing messages to a global and a per chat rate, zero
+// rate is unlimited
+type outboxLimiter struct {
+	mu        sync.Mutex
+	global    *tokenBucket
+	chatRate  float64
+	chats     map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newOutboxLimiter(rate, perChat float64) *outboxLimiter {
+	now := time.Now()
+	l := &outboxLimiter{
+		chatRate:  perChat,
+		chats:     make(map[string]*tokenBucket),
+		lastSweep: now,
+	}
+	if rate > 0 {
+		// allow a burst of one second worth of messages
+		l.global = newTokenBucket(int(math.Ceil(rate)), rate, now)
+	}
+	return l
+}
+
+// wait blocks until a message can be sent to chatID or quit is closed, once
+// the bot is stopping messages go out without waiting
+func (l *outboxLimiter) wait(chatID string, quit <-chan struct{}) {
+	for {
+		d := l.reserve(chatID, time.Now())
+		if d == 0 {
+			return
+		}
+		select {
+		case <-time.After(d):
+		case <-quit:
+			return
+		}
+	}
+}
+
+// reserve takes a token for chatID and returns 0, or returns how long to wait
+// when the global or the chat limit is reached
+func (l *outboxLimiter) reserve(chatID string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var chat *tokenBucket
+	if l.chatRate > 0 {
+		// full buckets behave like new ones, forget them
+		if now.Sub(l.lastSweep) > time.Minute {
+			for id, b := range l.chats {
+				if b.full(now) {
+					delete(l.chats, id)
+				}
+			}
+			l.lastSweep = now
+		}
+		chat = l.chats[chatID]
+		if chat == nil {
+			chat = newTokenBucket(1, l.chatRate, now)
+			l.chats[chatID] = chat
+		}
+		if d := chat.wait(now); d > 0 {
+			return d
+		}
+	}
+	if l.global != nil {
+		if d := l.global.wait(now); d > 0 {
+			return d
+		}
+		l.global.take(now)
+	}
+	if chat != nil {
+		chat.take(now)
+	}
+	return 0
+}
+
+// SetOutboxRateLimit sets how many messages per second are sent overall and
+// to the same chat, zero is unlimited. The default is 30 and 1 following
+// telegram limits. It must be called before Start.
+func (t *Telegram) SetOutboxRateLimit(perSecond, perChatPerSecond float64) {
+	t.limiter = newOutboxLimiter(perSecond, perChatPerSecond)
+}
+
+// RateLimitMiddleware drops messages from a user that sends more than
+// perMinute messages in a minute, zero or less is unlimited. Messages without
+// a sender such as channel posts are not limited. Dropped messages are counted
+// in telegram.input.rateLimited of r, pass the registry of the bot given to
+// SetMetricsRegistry or nil for metrics.DefaultRegistry.
+func RateLimitMiddleware(perMinute int, r metrics.Registry) Middleware {
+	if perMinute <= 0 {
+		return func(Message) bool { return true }
+	}
+	if r == nil {
+		r = metrics.DefaultRegistry
+	}
+	limited := metrics.GetOrRegisterCounter("telegram.input.rateLimited", r)
+
+	var mu sync.Mutex
+	buckets := make(map[string]*tokenBucket)
+	lastSweep := time.Now()
+
+	return func(m Message) bool {
+		if m.From.ID == "" {
+			return true
+		}
+
+		now := time.Now()
+		mu.Lock()
+		defer mu.Unlock()
+
+		// a full bucket behaves like a new one, forget them so the map
+		// doesn't grow with every user ever seen
+		if now.Sub(lastSweep) > time.Minute {
+			for id, b := range buckets {
+				if b.full(now) {
+					delete(buckets, id)
+				}
+			}
+			lastSweep = now
+		}
+
+		b, ok := buckets[m.From.ID]
+		if !ok {
+			b = newTokenBucket(perMinute, float64(perMinute)/60, now)
+			buckets[m.From.ID] = b
+		}
+		if !b.take(now) {
+			limited.Inc(1)
+			return false
+		}
+		return true
+	}
+}
@@ -0,0 +1,166 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sendTimes records when each chat received a sendMessage
+type sendTimes struct {
+	mu    sync.Mutex
+	times map[string][]time.Time
+	all   []time.Time
+}
+
+func (s *sendTimes) handler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/sendMessage") {
+		var body struct {
+			ChatID string `json:"chat_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		s.mu.Lock()
+		if s.times == nil {
+			s.times = make(map[string][]time.Time)
+		}
+		s.times[body.ChatID] = append(s.times[body.ChatID], time.Now())
+		s.all = append(s.all, time.Now())
+		s.mu.Unlock()
+	}
+	okHandler(map[string]string{"sendMessage": `{"message_id":1,"chat":{"id":1}}`})(w, r)
+}
+
+func (s *sendTimes) wait(t *testing.T, n int) []time.Time {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		s.mu.Lock()
+		all := append([]time.Time(nil), s.all...)
+		s.mu.Unlock()
+		if len(all) >= n {
+			return all
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages sent, want %d", len(all), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOutboxRateLimit(t *testing.T) {
+	var sent sendTimes
+	tg := newTestTelegram(t, sent.handler)
+	tg.SetOutboxRateLimit(50, 0)
+	tg.poolOutbox()
+	t.Cleanup(func() { tg.Stop(context.Background()) })
+
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		tg.output <- Message{Chat: Chat{ID: strconv.Itoa(i)}, Text: "hi"}
+	}
+	all := sent.wait(t, 100)
+
+	// a burst of 50 then 50 more at 50 per second
+	if took := all[99].Sub(start); took < 900*time.Millisecond {
+		t.Errorf("100 messages sent in %s, want about 1s at 50/s", took)
+	}
+	for i := range all {
+		n := 0
+		for _, at := range all[i:] {
+			if at.Sub(all[i]) < 500*time.Millisecond {
+				n++
+			}
+		}
+		if n > 50+25+5 {
+			t.Fatalf("%d messages sent within 500ms, want at most the burst and 25 more", n)
+		}
+	}
+}
+
+// sameWorker returns a chat id other than chatID sent by the same worker
+func sameWorker(chatID string) string {
+	worker := func(id string) int {
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		return int(h.Sum32()) % OutboxWorker
+	}
+	for i := 2; ; i++ {
+		id := strconv.Itoa(i)
+		if worker(id) == worker(chatID) {
+			return id
+		}
+	}
+}
+
+func TestOutboxBusyChatDoesNotBlockWorker(t *testing.T) {
+	var sent sendTimes
+	tg := newTestTelegram(t, sent.handler)
+	tg.SetOutboxRateLimit(0, 1)
+	tg.poolOutbox()
+	t.Cleanup(func() { tg.Stop(context.Background()) })
+
+	other := sameWorker("1")
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		tg.output <- Message{Chat: Chat{ID: "1"}, Text: "busy"}
+	}
+	tg.output <- Message{Chat: Chat{ID: other}, Text: "quiet"}
+	sent.wait(t, 4)
+
+	sent.mu.Lock()
+	defer sent.mu.Unlock()
+	if got := sent.times[other][0].Sub(start); got > 500*time.Millisecond {
+		t.Errorf("message to chat %s waited %s behind the busy chat", other, got)
+	}
+	busy := sent.times["1"]
+	for i := 1; i < len(busy); i++ {
+		if gap := busy[i].Sub(busy[i-1]); gap < 900*time.Millisecond {
+			t.Errorf("busy chat messages %s apart, want 1 per second", gap)
+		}
+	}
+}
+
+func TestStopDoesNotWaitForLimiter(t *testing.T) {
+	var sent sendTimes
+	tg := newTestTelegram(t, sent.handler)
+	tg.SetOutboxRateLimit(0, 1)
+	tg.poolOutbox()
+
+	for i := 0; i < 5; i++ {
+		tg.output <- Message{Chat: Chat{ID: "1"}, Text: "queued"}
+	}
+	start := time.Now()
+	if err := tg.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("Stop took %s waiting for the per chat limit", took)
+	}
+	if all := sent.wait(t, 5); len(all) != 5 {
+		t.Errorf("sent %d messages, want 5", len(all))
+	}
+}
+
+func TestLimiterWaitQuit(t *testing.T) {
+	l := newOutboxLimiter(0, 0.01)
+	l.wait("1", nil)
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		l.wait("1", quit)
+		close(done)
+	}()
+	close(quit)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait ignored quit")
+	}
+}
@@ -0,0 +1,57 @@
+package bot
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// maxReplayLine is the longest update StartReplay reads
+const maxReplayLine = 1 << 20
+
+// SetReplayDelay sets the pause between updates sent by StartReplay, zero
+// replays as fast as plugins take them
+func (t *Telegram) SetReplayDelay(d time.Duration) {
+	t.replayDelay = d
+}
+
+// StartReplay sends updates read from r to plugins instead of getting them
+// from telegram, for example ones recorded with SetRawUpdateSink. r has one
+// update json per line. Messages sent by plugins go through the outbox as
+// usual. It returns when r is exhausted or the bot is stopped.
+func (t *Telegram) StartReplay(r io.Reader) error {
+	t.poolOutbox()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxReplayLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var update TUpdate
+		if err := json.Unmarshal(scanner.Bytes(), &update); err != nil {
+			return fmt.Errorf("decoding update at line %d: %s", line, err)
+		}
+		t.dispatchUpdate(update, time.Now())
+
+		if t.replayDelay > 0 {
+			select {
+			case <-t.quit:
+				return nil
+			case <-time.After(t.replayDelay):
+			}
+		}
+		select {
+		case <-t.quit:
+			return nil
+		default:
+		}
+	}
+
+	return scanner.Err()
+}
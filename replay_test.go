@@ -0,0 +1,48 @@
+package bot
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartReplay(t *testing.T) {
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+	tg.SetReplayDelay(time.Millisecond)
+
+	recorded := `{"update_id":1,"message":{"message_id":1,"chat":{"id":5,"type":"private"},"text":"one"}}
+{"update_id":2,"message":{"message_id":2,"chat":{"id":5,"type":"private"},"text":"two"}}
+
+{"update_id":3,"message":{"message_id":3,"chat":{"id":5,"type":"private"},"text":"three"}}
+`
+	if err := tg.StartReplay(strings.NewReader(recorded)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"one", "two", "three"} {
+		m, ok := p.next(t).(*Message)
+		if !ok || m.Text != want {
+			t.Fatalf("got %#v, want message %q", m, want)
+		}
+	}
+	p.noUpdate(t, 50*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tg.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartReplayInvalid(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	err := tg.StartReplay(strings.NewReader("{\"update_id\":1}\nnot json\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("err = %v, want decoding error at line 2", err)
+	}
+}
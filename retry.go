@@ -0,0 +1,99 @@
+package bot
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+var (
+	defaultRetryAttempts = 3
+	defaultRetryBase     = 500 * time.Millisecond
+
+	// defaultRetryAfter is used when telegram rate limit us without telling
+	// how long to wait
+	defaultRetryAfter = 1 * time.Second
+
+	// maxRateLimitWaits is how many times a message waits for the rate limit
+	// of telegram before it is given up
+	maxRateLimitWaits = 3
+)
+
+// retryPolicy controls how transient failures are retried
+type retryPolicy struct {
+	maxAttempts int
+	base        time.Duration
+}
+
+// backoff returns the delay before the n-th retry (starting from 1), it grows
+// exponentially from base with jitter so clients don't retry in lockstep.
+func (p retryPolicy) backoff(n int) time.Duration {
+	d := p.base << uint(n-1)
+	if d <= 0 {
+		return 0
+	}
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// SetRetryPolicy sets how many times a request to telegram is attempted when
+// it fails with network error or 5xx response. The delay between attempts
+// starts at base and doubles after each attempt. Sending is only retried when
+// the request could not be sent at all, see Message.Retry to resend on
+// timeout.
+func (t *Telegram) SetRetryPolicy(maxAttempts int, base time.Duration) {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	t.retry = retryPolicy{maxAttempts: maxAttempts, base: base}
+}
+
+// retriable reports whether the request should be attempted again. An
+// idempotent request is retried on any network error or 5xx response. Other
+// requests are only retried when they never reached telegram, a timeout or a
+// 5xx may come after telegram already acted on it and retrying would for
+// example send a message twice.
+func retriable(resp *http.Response, err error, idempotent bool) bool {
+	if !idempotent {
+		return err != nil && notSent(err)
+	}
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= 500
+}
+
+// notSent reports whether err happened before the request was sent, such as
+// connection refused
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// doRetry calls do until it returns a non transient result or the attempts
+// of the retry policy are exhausted. The last result is returned. idempotent
+// tells whether do can safely be repeated after it may have reached telegram,
+// see retriable.
+func (t *Telegram) doRetry(name string, idempotent bool, do func() (*http.Response, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := do()
+		if !retriable(resp, err, idempotent) || attempt >= t.retry.maxAttempts {
+			return resp, err
+		}
+
+		d := t.retry.backoff(attempt)
+		t.log.Warn("request failed, retrying", zap.String("method", name), zap.Int("attempt", attempt), zap.String("delay", d.String()), zap.Error(err))
+		select {
+		case <-t.quit:
+			return resp, err
+		case <-time.After(d):
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyHandler fails the first n requests to method with status
+type flakyHandler struct {
+	method string
+	status int
+	n      int
+	next   http.HandlerFunc
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (f *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/"+f.method) {
+		f.mu.Lock()
+		f.calls++
+		fail := f.calls <= f.n
+		f.mu.Unlock()
+		if fail {
+			w.WriteHeader(f.status)
+			return
+		}
+	}
+	f.next(w, r)
+}
+
+func (f *flakyHandler) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func TestRetryGetUpdates(t *testing.T) {
+	var once sync.Once
+	flaky := &flakyHandler{method: "getUpdates", status: http.StatusBadGateway, n: 2}
+	flaky.next = func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/getUpdates") {
+			okHandler(nil)(w, r)
+			return
+		}
+		sent := false
+		once.Do(func() {
+			sent = true
+			w.Write([]byte(`{"ok":true,"result":[{"update_id":1,"message":{"message_id":1,"chat":{"id":1,"type":"private"},"text":"hi"}}]}`))
+		})
+		if !sent {
+			w.Write([]byte(`{"ok":true,"result":[]}`))
+		}
+	}
+	tg := newTestTelegram(t, flaky.ServeHTTP)
+	tg.SetRetryPolicy(3, time.Millisecond)
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+	startTestBot(t, tg)
+
+	if m, ok := p.next(t).(*Message); !ok || m.Text != "hi" {
+		t.Fatalf("got %#v, want the update after retrying", m)
+	}
+	if n := flaky.count(); n < 3 {
+		t.Errorf("getUpdates called %d times, want 3", n)
+	}
+}
+
+// refusedTransport fails the first n requests to method as if telegram could
+// not be reached
+type refusedTransport struct {
+	next   http.RoundTripper
+	method string
+	n      int
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (f *refusedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(r.URL.Path, "/"+f.method) {
+		return f.next.RoundTrip(r)
+	}
+	f.mu.Lock()
+	f.calls++
+	fail := f.calls <= f.n
+	f.mu.Unlock()
+	if fail {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	return f.next.RoundTrip(r)
+}
+
+func TestRetrySendNotSent(t *testing.T) {
+	var mu sync.Mutex
+	sent := 0
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sent++
+		mu.Unlock()
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
+	})
+	tg.client.Transport = &refusedTransport{next: tg.client.Transport, method: "sendMessage", n: 2}
+	tg.SetRetryPolicy(3, time.Millisecond)
+
+	if _, err := tg.SendMessage(Message{Chat: Chat{ID: "1"}, Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if sent != 1 {
+		t.Errorf("sent %d messages, want 1", sent)
+	}
+}
+
+func TestRetrySendServerError(t *testing.T) {
+	flaky := &flakyHandler{method: "sendMessage", status: http.StatusServiceUnavailable, n: 2}
+	flaky.next = func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
+	}
+	tg := newTestTelegram(t, flaky.ServeHTTP)
+	tg.SetRetryPolicy(3, time.Millisecond)
+
+	if _, err := tg.SendMessage(Message{Chat: Chat{ID: "1"}, Text: "hi"}); err == nil {
+		t.Fatal("want the error of the first attempt")
+	}
+	if n := flaky.count(); n != 1 {
+		t.Errorf("sendMessage called %d times, want 1 as it may have reached telegram", n)
+	}
+}
+
+func TestRetryClientError(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	tg.SetRetryPolicy(3, time.Millisecond)
+	calls := 0
+	resp, _ := tg.doRetry("getUpdates", true, func() (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: http.StatusBadRequest, Body: http.NoBody}, nil
+	})
+	if resp.StatusCode != http.StatusBadRequest || calls != 1 {
+		t.Errorf("400 was attempted %d times, want 1", calls)
+	}
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var mu sync.Mutex
+	var calls []time.Time
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, time.Now())
+		n := len(calls)
+		mu.Unlock()
+		if n == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1","parameters":{"retry_after":1}}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":{"message_id":5,"chat":{"id":1}}}`))
+	})
+	tg.poolOutbox()
+	defer tg.Stop(context.Background())
+
+	tg.output <- Message{Chat: Chat{ID: "1"}, Text: "hi"}
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(calls) == 2
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if gap := calls[1].Sub(calls[0]); gap < time.Second {
+		t.Errorf("retried after %s, want to wait retry_after 1s", gap)
+	}
+}
+
+func TestRetryAfterGivesUp(t *testing.T) {
+	defer func(d time.Duration) { defaultRetryAfter = d }(defaultRetryAfter)
+	defaultRetryAfter = time.Millisecond
+
+	var mu sync.Mutex
+	calls := 0
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests"}`))
+	})
+	tg.poolOutbox()
+
+	tg.output <- Message{Chat: Chat{ID: "1"}, Text: "hi"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls >= maxRateLimitWaits+1
+	})
+	time.Sleep(50 * time.Millisecond)
+	if err := tg.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != maxRateLimitWaits+1 {
+		t.Errorf("sendMessage called %d times, want %d", calls, maxRateLimitWaits+1)
+	}
+}
+
+func TestRetryAfterStop(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 60","parameters":{"retry_after":60}}`))
+	})
+	tg.poolOutbox()
+
+	result := make(chan SendResult, 1)
+	tg.output <- Message{Chat: Chat{ID: "1"}, Text: "hi", Result: result}
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls == 1
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tg.Stop(ctx); err != nil {
+		t.Fatalf("Stop kept waiting for retry_after: %v", err)
+	}
+	if r := <-result; r.Err != ErrStopped {
+		t.Errorf("got %v, want ErrStopped", r.Err)
+	}
+}
+
+func TestNoResendAfterReadTimeout(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	release := make(chan struct{})
+	defer close(release)
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		// telegram got the message but the response is lost
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+	})
+	tg.client.Timeout = 50 * time.Millisecond
+	tg.SetRetryPolicy(3, time.Millisecond)
+
+	_, err := tg.SendMessage(Message{Chat: Chat{ID: "1"}, Text: "hi"})
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("sendMessage called %d times after a read timeout, want 1", calls)
+	}
+}
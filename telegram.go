@@ -2,44 +2,62 @@ package bot
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/rcrowley/go-metrics"
 	"github.com/uber-go/zap"
 )
 
+const jsonContentType = "application/json; charset=utf-8"
+
+// defaultBaseURL is the telegram bot API server, see SetBaseURL
+const defaultBaseURL = "https://api.telegram.org"
+
+// maxMessageLength is the longest text telegram accepts in a message
+const maxMessageLength = 4096
+
 var (
 	OutboxBufferSize = 200
 	poolDuration     = 1 * time.Second
+	httpTimeout      = 35 * time.Second
 	log              zap.Logger
 	maxMsgPerUpdates = 100
 	OutboxWorker     = 5
-
-	// stats
-	msgPerUpdateCount   = metrics.NewRegisteredCounter("telegram.messagePerUpdate", metrics.DefaultRegistry)
-	updateCount         = metrics.NewRegisteredCounter("telegram.updates.count", metrics.DefaultRegistry)
-	updateDuration      = metrics.NewRegisteredTimer("telegram.updates.duration", metrics.DefaultRegistry)
-	sendMessageDuration = metrics.NewRegisteredTimer("telegram.sendMessage.duration", metrics.DefaultRegistry)
-	msgTimeoutCount     = metrics.NewRegisteredCounter("telegram.sendMessage.timeout", metrics.DefaultRegistry)
-	msgFailedCount      = metrics.NewRegisteredCounter("telegram.sendMessage.failed", metrics.DefaultRegistry)
-	msgDiscardedCount   = metrics.NewRegisteredCounter("telegram.sendMessage.discarded", metrics.DefaultRegistry)
-	msgDroppedCount     = metrics.NewRegisteredCounter("telegram.sendMessage.dropped", metrics.DefaultRegistry)
+	ErrorBufferSize  = 100
 
 	// compile time info
 	VERSION = ""
 )
 
+// defaultPollJitter spreads poll sleep of instances started together
+const defaultPollJitter = 0.2
+
+// minPollInterval keeps short polling from turning into a busy loop
+const minPollInterval = 10 * time.Millisecond
+
 func init() {
 	log = zap.NewJSON(zap.AddCaller(), zap.AddStacks(zap.FatalLevel))
 }
 
+// SetLogger sets the logger of Telegram created afterwards.
+//
+// Deprecated: use Telegram.SetLogger.
 func SetLogger(l zap.Logger) {
 	log = l.With(zap.String("module", "bot"))
 }
@@ -50,406 +68,2718 @@ func SetLogger(l zap.Logger) {
 
 // TResponse represents response from telegram
 type TResponse struct {
-	Ok          bool            `json:"ok"`
-	Result      json.RawMessage `json:"result,omitempty"`
-	ErrorCode   int64           `json:"error_code,omitempty"`
-	Description string          `json:"description"`
+	Ok          bool                 `json:"ok"`
+	Result      json.RawMessage      `json:"result,omitempty"`
+	ErrorCode   int64                `json:"error_code,omitempty"`
+	Description string               `json:"description"`
+	Parameters  *TResponseParameters `json:"parameters,omitempty"`
+}
+
+// TResponseParameters contains information about why a request was unsuccessful
+type TResponseParameters struct {
+	MigrateToChatID int64 `json:"migrate_to_chat_id,omitempty"`
+	RetryAfter      int   `json:"retry_after,omitempty"`
 }
 
-// TUpdate represents an update event from telegram
+// TUpdate represents an update event from telegram, ChannelPost and
+// EditedChannelPost are messages posted in a channel
 type TUpdate struct {
-	UpdateID int64           `json:"update_id"`
-	Message  json.RawMessage `json:"message"`
+	UpdateID          int64               `json:"update_id"`
+	Message           json.RawMessage     `json:"message"`
+	EditedMessage     json.RawMessage     `json:"edited_message,omitempty"`
+	ChannelPost       json.RawMessage     `json:"channel_post,omitempty"`
+	EditedChannelPost json.RawMessage     `json:"edited_channel_post,omitempty"`
+	CallbackQuery     *TCallbackQuery     `json:"callback_query,omitempty"`
+	PollAnswer        *TPollAnswer        `json:"poll_answer,omitempty"`
+	InlineQuery       *TInlineQuery       `json:"inline_query,omitempty"`
+	MyChatMember      *TChatMemberUpdated `json:"my_chat_member,omitempty"`
 }
 
-// TMessage is Telegram incomming message
-type TMessage struct {
-	MessageID       int64     `json:"message_id"`
+// TCallbackQuery is sent when user press a button of inline keyboard
+type TCallbackQuery struct {
+	ID              string    `json:"id"`
 	From            TUser     `json:"from"`
-	Date            int64     `json:"date"`
-	Chat            TChat     `json:"chat"`
-	Text            string    `json:"text"`
-	ParseMode       string    `json:"parse_mode,omitempty"`
-	MigrateToChatID *int64    `json:"migrate_to_chat_id,omitempty"`
-	ReplyTo         *TMessage `json:"reply_to_message,omitempty"`
-	NewChatMember   TUser     `json:"new_chat_member,omitempty"`
-	LeftChatMember  TUser     `json:"left_chat_member,omitempty"`
-	ReceivedAt      time.Time `json:"-"`
+	Message         *TMessage `json:"message,omitempty"`
+	InlineMessageID string    `json:"inline_message_id,omitempty"`
+	ChatInstance    string    `json:"chat_instance"`
+	Data            string    `json:"data,omitempty"`
 }
 
-// TOutMessage is Telegram outgoing message
-type TOutMessage struct {
-	ChatID    string `json:"chat_id"`
-	Text      string `json:"text"`
-	ParseMode string `json:"parse_mode,omitempty"`
+// TChatMemberUpdated is sent when status of a chat member changes
+type TChatMemberUpdated struct {
+	Chat          TChat       `json:"chat"`
+	From          TUser       `json:"from"`
+	Date          int64       `json:"date"`
+	OldChatMember TChatMember `json:"old_chat_member"`
+	NewChatMember TChatMember `json:"new_chat_member"`
 }
 
-// TUser is Telegram User
-type TUser struct {
-	ID        int64  `json:"id"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Username  string `json:"username"`
+// TInlineQuery is sent when user types "@bot query" in a chat
+type TInlineQuery struct {
+	ID     string `json:"id"`
+	From   TUser  `json:"from"`
+	Query  string `json:"query"`
+	Offset string `json:"offset"`
 }
 
-// TChat represents Telegram chat session
-type TChat struct {
-	Type  string `json:"type"`
-	Title string `json:"title"`
-	TUser
+// TInlineQueryResultArticle is an inline query result sending a text message
+type TInlineQueryResultArticle struct {
+	Type                string                   `json:"type"`
+	ID                  string                   `json:"id"`
+	Title               string                   `json:"title"`
+	InputMessageContent TInputTextMessageContent `json:"input_message_content"`
+	URL                 string                   `json:"url,omitempty"`
+	Description         string                   `json:"description,omitempty"`
 }
 
-// TChatMember represent user membership of a group
-type TChatMember struct {
-	User   TUser `json:"user"`
-	Status string
+// TInputTextMessageContent is the text message sent for an inline query result
+type TInputTextMessageContent struct {
+	MessageText string `json:"message_text"`
+	ParseMode   string `json:"parse_mode,omitempty"`
 }
 
-// TChatTypeMap maps betwwen string to bot.ChatType
-var TChatTypeMap = map[string]ChatType{
-	"private":    Private,
-	"group":      Group,
-	"supergroup": SuperGroup,
-	"channel":    Channel,
+// TPollAnswer is sent when user changes their answer of a non anonymous poll
+type TPollAnswer struct {
+	PollID    string `json:"poll_id"`
+	User      *TUser `json:"user,omitempty"`
+	OptionIDs []int  `json:"option_ids"`
 }
 
-// Telegram API
-type Telegram struct {
-	url        string
-	input      map[Plugin]chan interface{}
-	output     chan Message
-	quit       chan struct{}
-	lastUpdate int64
+// TMessage is Telegram incomming message
+type TMessage struct {
+	MessageID       int64            `json:"message_id"`
+	From            *TUser           `json:"from,omitempty"`
+	Date            int64            `json:"date"`
+	EditDate        int64            `json:"edit_date,omitempty"`
+	Chat            TChat            `json:"chat"`
+	Text            string           `json:"text"`
+	Entities        []TMessageEntity `json:"entities,omitempty"`
+	Caption         string           `json:"caption,omitempty"`
+	CaptionEntities []TMessageEntity `json:"caption_entities,omitempty"`
+	Photo           []TPhotoSize     `json:"photo,omitempty"`
+	Video           *TVideo          `json:"video,omitempty"`
+	Animation       *TVideo          `json:"animation,omitempty"`
+	Location        *TLocation       `json:"location,omitempty"`
+	Contact         *TContact        `json:"contact,omitempty"`
+	ParseMode       string           `json:"parse_mode,omitempty"`
+	MigrateToChatID *int64           `json:"migrate_to_chat_id,omitempty"`
+	ReplyTo         *TMessage        `json:"reply_to_message,omitempty"`
+	NewChatMembers  []TUser          `json:"new_chat_members,omitempty"`
+	LeftChatMember  *TUser           `json:"left_chat_member,omitempty"`
+	MediaGroupID    string           `json:"media_group_id,omitempty"`
+	MessageThreadID int64            `json:"message_thread_id,omitempty"`
+	Dice            *TDice           `json:"dice,omitempty"`
+	ForwardFrom     *TUser           `json:"forward_from,omitempty"`
+	ForwardFromChat *TChat           `json:"forward_from_chat,omitempty"`
+	ForwardDate     int64            `json:"forward_date,omitempty"`
+	ForwardOrigin   *TMessageOrigin  `json:"forward_origin,omitempty"`
+	ReceivedAt      time.Time        `json:"-"`
 }
 
-// NewTelegram creates telegram API Client
-func NewTelegram(key string) *Telegram {
-	if key == "" {
-		log.Fatal("telegram API key must not be empty")
-	}
-	return &Telegram{
-		url:    fmt.Sprintf("https://api.telegram.org/bot%s", key),
-		input:  make(map[Plugin]chan interface{}),
-		output: make(chan Message, OutboxBufferSize),
-		quit:   make(chan struct{}),
-	}
+// TMessageOrigin is the origin of a forwarded message, Type is "user",
+// "hidden_user", "chat" or "channel"
+type TMessageOrigin struct {
+	Type           string `json:"type"`
+	Date           int64  `json:"date"`
+	SenderUser     *TUser `json:"sender_user,omitempty"`
+	SenderUserName string `json:"sender_user_name,omitempty"`
+	SenderChat     *TChat `json:"sender_chat,omitempty"`
+	Chat           *TChat `json:"chat,omitempty"`
 }
 
-//AddPlugin add processing module to telegram
-func (t *Telegram) AddPlugin(p Plugin) error {
-	input, err := p.Init(t.output)
-	if err != nil {
-		return err
-	}
-	t.input[p] = input
+// TMessageEntity is special part of message text such as mention or url.
+// Offset and Length are in UTF-16 code units.
+type TMessageEntity struct {
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	URL    string `json:"url,omitempty"`
+	User   *TUser `json:"user,omitempty"`
+}
 
-	return nil
+// TPhotoSize is one size of a Telegram photo
+type TPhotoSize struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	FileSize     int    `json:"file_size,omitempty"`
 }
 
-// Start consuming from telegram
-func (t *Telegram) Start() {
-	t.poolOutbox()
-	t.poolInbox()
+// TVideo is a video file, animation has the same fields
+type TVideo struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	Duration     int    `json:"duration"`
+	MimeType     string `json:"mime_type,omitempty"`
+	FileSize     int    `json:"file_size,omitempty"`
 }
 
-func (t *Telegram) poolOutbox() {
-	// fork incomming message, group by msg.Chat.ID to the workers
-	inChs := make([]chan Message, OutboxWorker)
-	for i := 0; i < OutboxWorker; i++ {
-		inChs[i] = make(chan Message)
-	}
+// TLocation is a point on the map
+type TLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
 
-	go func() {
-		h := fnv.New32a()
-		for {
-			h.Reset()
-			m := <-t.output
-			h.Write([]byte(m.Chat.ID))
-			i := int(h.Sum32()) % OutboxWorker
-			inChs[i] <- m
-		}
-	}()
+// TContact is a phone contact, UserID is set when the contact is a telegram
+// user
+type TContact struct {
+	PhoneNumber string `json:"phone_number"`
+	FirstName   string `json:"first_name"`
+	LastName    string `json:"last_name,omitempty"`
+	UserID      int64  `json:"user_id,omitempty"`
+}
 
-	for i := 0; i < OutboxWorker; i++ {
-		go func(i int) {
-			input := inChs[i]
-
-		NEXTMESSAGE:
-			for {
-				select {
-				case m := <-input:
-					log.Debug("processing message", zap.String("chanID", m.Chat.ID), zap.Int("worker", i))
-					if !m.DiscardAfter.IsZero() && time.Now().After(m.DiscardAfter) {
-						msgDiscardedCount.Inc(1)
-						log.Warn("discarded message", zap.Object("msg", m), zap.Int("worker", i))
-						continue
-					}
+// TOutMessage is Telegram outgoing message
+type TOutMessage struct {
+	ChatID                string      `json:"chat_id"`
+	Text                  string      `json:"text"`
+	ParseMode             string      `json:"parse_mode,omitempty"`
+	ReplyToMessageID      int64       `json:"reply_to_message_id,omitempty"`
+	MessageThreadID       int64       `json:"message_thread_id,omitempty"`
+	ReplyMarkup           interface{} `json:"reply_markup,omitempty"`
+	DisableWebPagePreview bool        `json:"disable_web_page_preview,omitempty"`
+	DisableNotification   bool        `json:"disable_notification,omitempty"`
+	ProtectContent        bool        `json:"protect_content,omitempty"`
+}
 
-					outMsg := TOutMessage{
-						ChatID:    m.Chat.ID,
-						Text:      m.Text,
-						ParseMode: string(m.Format),
-					}
+// TInlineKeyboardMarkup is inline keyboard that appears next to the message
+type TInlineKeyboardMarkup struct {
+	InlineKeyboard [][]TInlineKeyboardButton `json:"inline_keyboard"`
+}
 
-					var b bytes.Buffer
-					if err := json.NewEncoder(&b).Encode(outMsg); err != nil {
-						log.Error("encoding message", zap.Error(err))
-						continue
-					}
-					started := time.Now()
-					jsonMsg := b.String()
-
-					var tresp TResponse
-					var err error
-					retries := m.Retry
-					for {
-						if retries < 0 {
-							if m.Retry > 0 {
-								metrics.GetOrRegisterCounter(fmt.Sprintf("telegram.sendMessage.droppedAfter.%d", m.Retry), metrics.DefaultRegistry).Inc(1)
-							}
-							log.Error("message dropped, not retrying", zap.Object("msg", m), zap.Int("worker", i))
-							msgDroppedCount.Inc(1)
-							continue NEXTMESSAGE
-						}
-
-						if !m.DiscardAfter.IsZero() && time.Now().After(m.DiscardAfter) {
-							log.Error("message dropped, discarded", zap.Object("msg", m), zap.Int("worker", i))
-							msgDiscardedCount.Inc(1)
-							continue NEXTMESSAGE
-						}
-						retries--
-
-						var resp *http.Response
-						resp, err = http.Post(fmt.Sprintf("%s/sendMessage", t.url), "application/json; charset=utf-10", &b)
-						if err != nil {
-							msgFailedCount.Inc(1)
-							// check for timeout
-							if netError, ok := err.(net.Error); ok && netError.Timeout() {
-								msgTimeoutCount.Inc(1)
-								log.Error("sendMessage timeout", zap.String("ChatID", outMsg.ChatID), zap.Error(err), zap.Int("retries", retries), zap.Int("worker", i))
-								continue
-							}
-
-							// unknown error
-							msgDroppedCount.Inc(1)
-							log.Error("sendMessage failed, dropped", zap.String("ChatID", outMsg.ChatID), zap.Error(err), zap.Object("msg", m), zap.Int("worker", i))
-							continue NEXTMESSAGE
-						}
-						metrics.GetOrRegisterCounter(fmt.Sprintf("telegram.sendMessage.http.%d", resp.StatusCode), metrics.DefaultRegistry).Inc(1)
-
-						if resp.StatusCode == 429 { // rate limited by telegram
-							msgFailedCount.Inc(1)
-							if tresp, err = parseResponse(resp); err != nil {
-								log.Error("sendMessage 429", zap.Error(err))
-								var delay int
-								if n, err := fmt.Sscanf(tresp.Description, "Too Many Requests: retry after %d", &delay); err != nil && n == 1 {
-									if delay > 0 {
-										d := time.Duration(delay) * time.Second
-										log.Warn("sendMessage delayed", zap.String("delay", d.String()))
-										time.Sleep(d)
-									}
-								}
-							}
-							resp.Body.Close()
-							continue
-						}
-
-						resp.Body.Close()
-						break
-					}
+// TReplyKeyboardMarkup is custom keyboard replacing the user keyboard
+type TReplyKeyboardMarkup struct {
+	Keyboard        [][]TKeyboardButton `json:"keyboard"`
+	OneTimeKeyboard bool                `json:"one_time_keyboard,omitempty"`
+	ResizeKeyboard  bool                `json:"resize_keyboard,omitempty"`
+}
 
-					attempt := retries - m.Retry + 1
-					metrics.GetOrRegisterCounter(fmt.Sprintf("telegram.sendMessage.retry.%d", attempt), metrics.DefaultRegistry).Inc(1)
+// TKeyboardButton is a button of custom keyboard
+type TKeyboardButton struct {
+	Text string `json:"text"`
+}
 
-					sendMessageDuration.UpdateSince(started)
-					if err != nil {
-						log.Error("parsing sendMessage response failed", zap.String("ChatID", outMsg.ChatID), zap.Error(err), zap.Object("msg", jsonMsg), zap.Int("worker", i))
-					}
-				case <-t.quit:
-					return
-				}
-			}
-		}(i)
-	}
+// TReplyKeyboardRemove removes custom keyboard
+type TReplyKeyboardRemove struct {
+	RemoveKeyboard bool `json:"remove_keyboard"`
 }
 
-func (t *Telegram) poolInbox() {
-	for {
-		select {
-		case <-t.quit:
-			return
-		default:
-			started := time.Now()
-			resp, err := http.Get(fmt.Sprintf("%s/getUpdates?offset=%d", t.url, t.lastUpdate+1))
-			if err != nil {
-				log.Error("getUpdates failed", zap.Error(err))
-				updateDuration.UpdateSince(started)
-				continue
-			}
-			updateDuration.UpdateSince(started)
-			updateCount.Inc(1)
-			metrics.GetOrRegisterCounter(fmt.Sprintf("telegram.getUpdates.http.%d", resp.StatusCode), metrics.DefaultRegistry).Inc(1)
+// TInlineKeyboardButton is a button of inline keyboard
+type TInlineKeyboardButton struct {
+	Text         string `json:"text"`
+	URL          string `json:"url,omitempty"`
+	CallbackData string `json:"callback_data,omitempty"`
+}
 
-			nMsg, err := t.parseInbox(resp)
+// TOutPhoto is Telegram outgoing photo
+type TOutPhoto struct {
+	ChatID         string `json:"chat_id"`
+	Photo          string `json:"photo"`
+	Caption        string `json:"caption,omitempty"`
+	ParseMode      string `json:"parse_mode,omitempty"`
+	ProtectContent bool   `json:"protect_content,omitempty"`
+}
+
+// outgoing is a message queued in the outbox, ready to be posted to telegram
+type outgoing struct {
+	method       string
+	chatID       string
+	payload      interface{}
+	retry        int
+	discardAfter time.Time
+	msg          interface{}
+	result       chan<- SendResult
+}
+
+// newOutgoing converts message put on the output channel by plugins. Text
+// longer than telegram limit is split into several messages.
+func (t *Telegram) newOutgoing(m interface{}) ([]outgoing, error) {
+	switch m := m.(type) {
+	case Message:
+		format, err := t.checkFormat(m.Format)
+		if err != nil {
+			return nil, err
+		}
+		m.Format = format
+
+		var out []outgoing
+		for _, chunk := range splitMessage(m) {
+			payload, err := newTOutMessage(chunk)
 			if err != nil {
-				log.Error("parsing updates response failed", zap.Error(err))
-			}
-			msgPerUpdateCount.Inc(int64(nMsg))
-			if nMsg != maxMsgPerUpdates {
-				time.Sleep(poolDuration)
+				return nil, err
 			}
+			out = append(out, outgoing{
+				method:       "sendMessage",
+				chatID:       chunk.Chat.ID,
+				payload:      payload,
+				retry:        chunk.Retry,
+				discardAfter: chunk.DiscardAfter,
+				msg:          chunk,
+				result:       chunk.Result,
+			})
+		}
+		return out, nil
+	case PhotoMessage:
+		format, err := t.checkFormat(m.Format)
+		if err != nil {
+			return nil, err
 		}
+		m.Format = format
+
+		return []outgoing{{
+			method:       "sendPhoto",
+			chatID:       m.Chat.ID,
+			payload:      newTOutPhoto(m),
+			retry:        m.Retry,
+			discardAfter: m.DiscardAfter,
+			msg:          m,
+		}}, nil
+	case *Message:
+		return t.newOutgoing(*m)
+	case *PhotoMessage:
+		return t.newOutgoing(*m)
 	}
+
+	return nil, fmt.Errorf("unsupported outgoing message type %T", m)
 }
 
-func (t *Telegram) parseInbox(resp *http.Response) (int, error) {
-	defer resp.Body.Close()
+// checkFormat returns the parse_mode telegram accepts for f, matching the
+// known formats ignoring case so "html" is HTML. An unknown format is sent as
+// plain text, or is an error with strict format.
+func (t *Telegram) checkFormat(f MessageFormat) (MessageFormat, error) {
+	for _, known := range []MessageFormat{Text, Markdown, MarkdownV2, HTML} {
+		if strings.EqualFold(string(f), string(known)) {
+			return known, nil
+		}
+	}
+	if t.strictFormat {
+		return f, fmt.Errorf("%w %q", ErrInvalidFormat, f)
+	}
+	t.log.Warn("unknown message format, sending as plain text", zap.String("format", string(f)))
+	return Text, nil
+}
 
-	receivedAt := time.Now()
-	decoder := json.NewDecoder(resp.Body)
-	var tresp TResponse
-	if err := decoder.Decode(&tresp); err != nil {
-		return 0, err
+// splitMessage splits m into messages with text not exceeding
+// maxMessageLength. The first message keeps the reply and the last keeps the
+// keyboards. Formatting entities spanning a split point will break.
+func splitMessage(m Message) []Message {
+	texts := splitText(m.Text, maxMessageLength)
+	if len(texts) == 1 {
+		return []Message{m}
 	}
 
-	if !tresp.Ok {
-		log.Error("parsing response failed", zap.Int64("errorCode", tresp.ErrorCode), zap.String("description", tresp.Description))
-		return 0, nil
+	msgs := make([]Message, len(texts))
+	for i, text := range texts {
+		msgs[i] = m
+		msgs[i].Text = text
+		if i > 0 {
+			msgs[i].ReplyMessageID = ""
+		}
+		if i < len(texts)-1 {
+			msgs[i].InlineKeyboard = nil
+			msgs[i].ReplyKeyboard = nil
+			msgs[i].RemoveKeyboard = false
+		}
 	}
+	return msgs
+}
 
-	var results []TUpdate
-	json.Unmarshal(tresp.Result, &results)
-	for _, update := range results {
-		var m TMessage
-		json.Unmarshal(update.Message, &m)
-		t.lastUpdate = update.UpdateID
-
-		var msg interface{}
-		message := Message{
-			ID: strconv.FormatInt(m.MessageID, 10),
-			From: User{
-				ID:        strconv.FormatInt(m.From.ID, 10),
-				FirstName: m.From.FirstName,
-				LastName:  m.From.LastName,
-				Username:  m.From.Username,
-			},
-			Date: time.Unix(m.Date, 0),
-			Chat: Chat{
-				ID:       strconv.FormatInt(m.Chat.ID, 10),
-				Type:     TChatTypeMap[m.Chat.Type],
-				Title:    m.Chat.Title,
-				Username: m.Chat.Username,
-			},
-			Text:       m.Text,
-			ReceivedAt: receivedAt,
-			Raw:        update.Message,
+// splitText splits text into chunks of at most max UTF-16 code units, which
+// is how telegram measures the length, preferring to cut after a newline then
+// after a space
+func splitText(text string, max int) []string {
+	runes := []rune(text)
+	var chunks []string
+	for {
+		fit := fitUTF16(runes, max)
+		if fit == len(runes) {
+			break
 		}
-		if m.MigrateToChatID != nil {
-			newChanID := strconv.FormatInt(*(m.MigrateToChatID), 10)
-			chanMigratedMsg := ChannelMigratedMessage{
-				Message:    message,
-				FromID:     message.Chat.ID,
-				ToID:       newChanID,
-				ReceivedAt: receivedAt,
-			}
-			msg = &chanMigratedMsg
+		cut := lastIndexRune(runes[:fit], '\n')
+		if cut < 0 {
+			cut = lastIndexRune(runes[:fit], ' ')
 		}
-		msg = &message
-		log.Debug("update", zap.Object("msg", msg))
-		for plugin, ch := range t.input {
-			select {
-			case ch <- msg:
-			default:
-				log.Warn("input channel full, skipping message", zap.String("plugin", plugin.Name()), zap.String("msgID", message.ID))
+		if cut < 0 {
+			cut = fit - 1
+		}
+		chunks = append(chunks, string(runes[:cut+1]))
+		runes = runes[cut+1:]
+	}
+	return append(chunks, string(runes))
+}
+
+// fitUTF16 returns how many of the first runes fit in max UTF-16 code units,
+// at least one
+func fitUTF16(runes []rune, max int) int {
+	units := 0
+	for i, r := range runes {
+		units += utf16Len(r)
+		if units > max {
+			if i == 0 {
+				return 1
 			}
+			return i
 		}
 	}
+	return len(runes)
+}
 
-	return len(results), nil
+func lastIndexRune(runes []rune, r rune) int {
+	for i := len(runes) - 1; i >= 0; i-- {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
 }
 
-func (t *Telegram) Leave(chanID string) error {
-	url := fmt.Sprintf("%s/leaveChat?chat_id=%s", t.url, url.QueryEscape(chanID))
-	resp, err := http.Get(url)
+func newTOutMessage(m Message) (TOutMessage, error) {
+	out := TOutMessage{
+		ChatID:                m.Chat.ID,
+		Text:                  m.Text,
+		ParseMode:             string(m.Format),
+		MessageThreadID:       m.MessageThreadID,
+		DisableWebPagePreview: m.DisableWebPagePreview,
+		DisableNotification:   m.DisableNotification,
+		ProtectContent:        m.ProtectContent,
+	}
+	if m.ReplyMessageID != "" {
+		// reply is not threaded if the id is invalid
+		out.ReplyToMessageID, _ = strconv.ParseInt(m.ReplyMessageID, 10, 64)
+	}
+
+	markup, err := newTReplyMarkup(m)
 	if err != nil {
-		log.Error("leave failed", zap.Error(err))
-		return err
+		return out, err
 	}
-	defer resp.Body.Close()
+	out.ReplyMarkup = markup
 
-	if _, err := parseResponse(resp); err != nil {
-		log.Error("leave invalid response", zap.Error(err))
-		return err
+	return out, nil
+}
+
+// newTReplyMarkup returns the keyboard attached to m, only one of them may be
+// set
+func newTReplyMarkup(m Message) (interface{}, error) {
+	var markups []interface{}
+	if len(m.InlineKeyboard) > 0 {
+		markups = append(markups, newTInlineKeyboardMarkup(m.InlineKeyboard))
+	}
+	if m.ReplyKeyboard != nil {
+		markups = append(markups, newTReplyKeyboardMarkup(*m.ReplyKeyboard))
+	}
+	if m.RemoveKeyboard {
+		markups = append(markups, &TReplyKeyboardRemove{RemoveKeyboard: true})
 	}
 
-	return nil
+	switch len(markups) {
+	case 0:
+		return nil, nil
+	case 1:
+		return markups[0], nil
+	}
+	return nil, errors.New("only one of InlineKeyboard, ReplyKeyboard or RemoveKeyboard can be set")
 }
 
-func (t *Telegram) Member(chanID, userID string) (*TChatMember, error) {
-	url := fmt.Sprintf("%s/getChatmember?chat_id=%s&user_id=%s", t.url, url.QueryEscape(chanID), url.QueryEscape(userID))
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Error("get member failed", zap.Error(err))
-		return nil, err
+func newTReplyKeyboardMarkup(k ReplyKeyboard) *TReplyKeyboardMarkup {
+	markup := TReplyKeyboardMarkup{
+		Keyboard:        make([][]TKeyboardButton, len(k.Rows)),
+		OneTimeKeyboard: k.OneTime,
+		ResizeKeyboard:  k.Resize,
 	}
-	defer resp.Body.Close()
+	for i, row := range k.Rows {
+		markup.Keyboard[i] = make([]TKeyboardButton, len(row))
+		for j, text := range row {
+			markup.Keyboard[i][j] = TKeyboardButton{Text: text}
+		}
+	}
+	return &markup
+}
 
-	tresp, err := parseResponse(resp)
-	if err != nil {
-		log.Error("get member invalid response", zap.Error(err))
-		return nil, err
+func newTInlineKeyboardMarkup(k InlineKeyboard) *TInlineKeyboardMarkup {
+	markup := TInlineKeyboardMarkup{
+		InlineKeyboard: make([][]TInlineKeyboardButton, len(k)),
 	}
+	for i, row := range k {
+		markup.InlineKeyboard[i] = make([]TInlineKeyboardButton, len(row))
+		for j, b := range row {
+			markup.InlineKeyboard[i][j] = TInlineKeyboardButton{
+				Text:         b.Text,
+				URL:          b.URL,
+				CallbackData: b.CallbackData,
+			}
+		}
+	}
+	return &markup
+}
 
-	var member TChatMember
-	if err := json.Unmarshal(tresp.Result, &member); err != nil {
-		return nil, err
+func newTOutPhoto(p PhotoMessage) TOutPhoto {
+	return TOutPhoto{
+		ChatID:         p.Chat.ID,
+		Photo:          p.Photo,
+		Caption:        p.Caption,
+		ParseMode:      string(p.Format),
+		ProtectContent: p.ProtectContent,
 	}
+}
 
-	return &member, nil
+// TUser is Telegram User
+type TUser struct {
+	ID           int64  `json:"id"`
+	IsBot        bool   `json:"is_bot"`
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name"`
+	Username     string `json:"username"`
+	LanguageCode string `json:"language_code,omitempty"`
 }
 
-func (t *Telegram) Kick(chanID, userID string) error {
-	url := fmt.Sprintf("%s/kickChatMember?chat_id=%s&user_id=%s", t.url, url.QueryEscape(chanID), url.QueryEscape(userID))
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Error("kick failed", zap.Error(err))
-		return err
+// TChat represents Telegram chat session. Description, InviteLink,
+// Permissions and PinnedMessage are only returned by GetChat.
+type TChat struct {
+	Type  string `json:"type"`
+	Title string `json:"title"`
+	TUser
+	Description   string            `json:"description,omitempty"`
+	InviteLink    string            `json:"invite_link,omitempty"`
+	Permissions   *TChatPermissions `json:"permissions,omitempty"`
+	PinnedMessage *TMessage         `json:"pinned_message,omitempty"`
+}
+
+// TChatPermissions are actions members of a chat are allowed to do
+type TChatPermissions struct {
+	CanSendMessages       bool `json:"can_send_messages"`
+	CanSendMediaMessages  bool `json:"can_send_media_messages"`
+	CanSendPolls          bool `json:"can_send_polls"`
+	CanSendOtherMessages  bool `json:"can_send_other_messages"`
+	CanAddWebPagePreviews bool `json:"can_add_web_page_previews"`
+	CanChangeInfo         bool `json:"can_change_info"`
+	CanInviteUsers        bool `json:"can_invite_users"`
+	CanPinMessages        bool `json:"can_pin_messages"`
+}
+
+func newTChatPermissions(p ChatPermissions) TChatPermissions {
+	return TChatPermissions{
+		CanSendMessages:       p.CanSendMessages,
+		CanSendMediaMessages:  p.CanSendMediaMessages,
+		CanSendPolls:          p.CanSendPolls,
+		CanSendOtherMessages:  p.CanSendOtherMessages,
+		CanAddWebPagePreviews: p.CanAddWebPagePreviews,
+		CanChangeInfo:         p.CanChangeInfo,
+		CanInviteUsers:        p.CanInviteUsers,
+		CanPinMessages:        p.CanPinMessages,
 	}
-	defer resp.Body.Close()
+}
 
-	if _, err := parseResponse(resp); err != nil {
-		log.Error("kick invalid response", zap.Error(err))
-		return err
+// TChatAdministratorRights are rights of an administrator in a chat
+type TChatAdministratorRights struct {
+	IsAnonymous         bool `json:"is_anonymous"`
+	CanManageChat       bool `json:"can_manage_chat"`
+	CanDeleteMessages   bool `json:"can_delete_messages"`
+	CanManageVideoChats bool `json:"can_manage_video_chats"`
+	CanRestrictMembers  bool `json:"can_restrict_members"`
+	CanPromoteMembers   bool `json:"can_promote_members"`
+	CanChangeInfo       bool `json:"can_change_info"`
+	CanInviteUsers      bool `json:"can_invite_users"`
+	CanPostMessages     bool `json:"can_post_messages"`
+	CanEditMessages     bool `json:"can_edit_messages"`
+	CanPinMessages      bool `json:"can_pin_messages"`
+}
+
+// TChatInviteLink is an invite link of a chat
+type TChatInviteLink struct {
+	InviteLink         string `json:"invite_link"`
+	ExpireDate         int64  `json:"expire_date"`
+	MemberLimit        int    `json:"member_limit"`
+	CreatesJoinRequest bool   `json:"creates_join_request"`
+	IsRevoked          bool   `json:"is_revoked"`
+}
+
+func newTChatAdministratorRights(r AdminRights) TChatAdministratorRights {
+	return TChatAdministratorRights{
+		IsAnonymous:         r.IsAnonymous,
+		CanManageChat:       r.CanManageChat,
+		CanDeleteMessages:   r.CanDeleteMessages,
+		CanManageVideoChats: r.CanManageVideoChats,
+		CanRestrictMembers:  r.CanRestrictMembers,
+		CanPromoteMembers:   r.CanPromoteMembers,
+		CanChangeInfo:       r.CanChangeInfo,
+		CanInviteUsers:      r.CanInviteUsers,
+		CanPostMessages:     r.CanPostMessages,
+		CanEditMessages:     r.CanEditMessages,
+		CanPinMessages:      r.CanPinMessages,
 	}
+}
 
-	return nil
+// TAnswerCallbackQuery is the answer to a callback query
+type TAnswerCallbackQuery struct {
+	CallbackQueryID string `json:"callback_query_id"`
+	Text            string `json:"text,omitempty"`
+	ShowAlert       bool   `json:"show_alert,omitempty"`
+	URL             string `json:"url,omitempty"`
+	CacheTime       int    `json:"cache_time,omitempty"`
 }
 
-func (t *Telegram) Unban(chanID, userID string) error {
-	url := fmt.Sprintf("%s/unbanChatMember?chat_id=%s&user_id=%s", t.url, url.QueryEscape(chanID), url.QueryEscape(userID))
-	resp, err := http.Get(url)
+// TEditMessageText changes text of a message, either ChatID and MessageID or
+// InlineMessageID must be set
+type TEditMessageText struct {
+	ChatID          string `json:"chat_id,omitempty"`
+	MessageID       int64  `json:"message_id,omitempty"`
+	InlineMessageID string `json:"inline_message_id,omitempty"`
+	Text            string `json:"text"`
+	ParseMode       string `json:"parse_mode,omitempty"`
+}
+
+// TForwardMessage is request to forward or copy a message to another chat
+type TForwardMessage struct {
+	ChatID     string `json:"chat_id"`
+	FromChatID string `json:"from_chat_id"`
+	MessageID  int64  `json:"message_id"`
+}
+
+// BotCommand is a command shown in the bot menu. Command must be 1-32
+// lowercase letters, digits or underscores.
+type BotCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+var apiKeyRe = regexp.MustCompile(`^[0-9]+:[A-Za-z0-9_-]+$`)
+
+var botCommandRe = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// TDice is an animated emoji with a random value
+type TDice struct {
+	Emoji string `json:"emoji"`
+	Value int    `json:"value"`
+}
+
+// diceEmoji are emoji accepted by sendDice
+var diceEmoji = map[string]bool{
+	"🎲": true,
+	"🎯": true,
+	"🏀": true,
+	"⚽": true,
+	"🎳": true,
+	"🎰": true,
+}
+
+// TInputMedia is an item of media group
+type TInputMedia struct {
+	Type      string `json:"type"`
+	Media     string `json:"media"`
+	Caption   string `json:"caption,omitempty"`
+	ParseMode string `json:"parse_mode,omitempty"`
+}
+
+// TFile represents a file ready to be downloaded
+type TFile struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	FileSize     int    `json:"file_size,omitempty"`
+	FilePath     string `json:"file_path,omitempty"`
+}
+
+// TChatMember represent user membership of a group
+type TChatMember struct {
+	User   TUser  `json:"user"`
+	Status string `json:"status"`
+}
+
+// ChatAction is status shown to the user while the bot is preparing a reply
+type ChatAction string
+
+// Available ChatAction
+const (
+	Typing          ChatAction = "typing"
+	UploadPhoto     ChatAction = "upload_photo"
+	RecordVideo     ChatAction = "record_video"
+	UploadVideo     ChatAction = "upload_video"
+	RecordVoice     ChatAction = "record_voice"
+	UploadVoice     ChatAction = "upload_voice"
+	UploadDocument  ChatAction = "upload_document"
+	ChooseSticker   ChatAction = "choose_sticker"
+	FindLocation    ChatAction = "find_location"
+	RecordVideoNote ChatAction = "record_video_note"
+	UploadVideoNote ChatAction = "upload_video_note"
+)
+
+// chatActionInterval is how often KeepChatAction resend the action, telegram
+// clears it after 5 seconds
+const chatActionInterval = 4 * time.Second
+
+// TChatTypeMap maps betwwen string to bot.ChatType
+var TChatTypeMap = map[string]ChatType{
+	"private":    Private,
+	"group":      Group,
+	"supergroup": SuperGroup,
+	"channel":    Channel,
+}
+
+// Telegram API
+type Telegram struct {
+	url        string
+	key        string
+	fileURL    string
+	inputMu    sync.RWMutex
+	input      map[Plugin]*pluginInput
+	output     chan interface{}
+	quit       chan struct{}
+	quitOnce   sync.Once
+	outboxDone chan struct{}
+	outboxRun  int32 // 1 once the outbox started, accessed atomically
+	started    int32 // 1 once Start was called, accessed atomically
+	errs       chan error
+	lastUpdate int64 // accessed atomically
+	lastPoll   int64 // unix nano of last successful getUpdates, accessed atomically
+	client     *http.Client
+	log        zap.Logger
+	metrics    metrics.Registry
+	stats      *stats
+	offsets    OffsetStore
+
+	meMu sync.Mutex
+	me   *TUser
+	// meFailed is when getMe last failed, see username
+	meFailed time.Time
+
+	middlewares  []Middleware
+	rawSink      func(json.RawMessage)
+	replayDelay  time.Duration
+	strictFormat bool
+	captionText  bool
+	inputPolicy  InputPolicy
+	inputTimeout time.Duration
+	deadLetters  chan<- Message
+	retry        retryPolicy
+	limiter      *outboxLimiter
+
+	// pollTimeout is the getUpdates long polling timeout, 0 means short polling
+	pollTimeout time.Duration
+	// updateLimit is the maximum number of updates of a getUpdates
+	updateLimit int
+	// pollInterval is the sleep between short polls, randomized by pollJitter
+	pollInterval time.Duration
+	pollJitter   float64
+	// allowedUpdates is json encoded list of update types to receive
+	allowedUpdates string
+
+	albumWindow time.Duration
+	albumMu     sync.Mutex
+	albums      map[string]*pendingAlbum
+	// albumsClosed is set on Stop, later album items are not buffered
+	albumsClosed bool
+
+	// resumed is closed by ResumeOutbox, nil when the outbox is not paused
+	pauseMu sync.Mutex
+	resumed chan struct{}
+
+	closePluginsOnce sync.Once
+}
+
+// pluginInput is the input channel of a plugin
+type pluginInput struct {
+	ch chan interface{}
+	// removed is closed by RemovePlugin to abort deliveries in progress
+	removed chan struct{}
+	// sending counts deliveries in progress, ch is closed once they are done
+	sending sync.WaitGroup
+	closed  int32 // 1 once Close of the plugin was called, accessed atomically
+}
+
+// NewTelegram creates telegram API Client, key is the token given by
+// BotFather such as "123456:ABC-DEF1234ghIkl"
+func NewTelegram(key string) (*Telegram, error) {
+	if key == "" {
+		return nil, errors.New("telegram API key must not be empty")
+	}
+	if !apiKeyRe.MatchString(key) {
+		return nil, errors.New("malformed telegram API key")
+	}
+
+	return &Telegram{
+		key:          key,
+		url:          fmt.Sprintf("%s/bot%s", defaultBaseURL, key),
+		fileURL:      fmt.Sprintf("%s/file/bot%s", defaultBaseURL, key),
+		input:        make(map[Plugin]*pluginInput),
+		output:       make(chan interface{}, OutboxBufferSize),
+		quit:         make(chan struct{}),
+		outboxDone:   make(chan struct{}),
+		errs:         make(chan error, ErrorBufferSize),
+		client:       &http.Client{Timeout: httpTimeout},
+		log:          log,
+		metrics:      metrics.DefaultRegistry,
+		stats:        newStats(metrics.DefaultRegistry),
+		retry:        retryPolicy{maxAttempts: defaultRetryAttempts, base: defaultRetryBase},
+		updateLimit:  maxMsgPerUpdates,
+		pollInterval: poolDuration,
+		pollJitter:   defaultPollJitter,
+		limiter:      newOutboxLimiter(defaultOutboxRate, defaultOutboxPerChat),
+		albums:       make(map[string]*pendingAlbum),
+	}, nil
+}
+
+// MustNewTelegram is like NewTelegram but exits the program on invalid key
+func MustNewTelegram(key string) *Telegram {
+	t, err := NewTelegram(key)
 	if err != nil {
-		log.Error("kick failed", zap.Error(err))
-		return err
+		log.Fatal("creating telegram failed", zap.Error(err))
 	}
-	defer resp.Body.Close()
+	return t
+}
+
+// AddPlugin add processing module to telegram. It can be called after Start,
+// the plugin receives updates that arrive after it was added.
+func (t *Telegram) AddPlugin(p Plugin) error {
+	t.inputMu.Lock()
+	defer t.inputMu.Unlock()
 
-	if _, err := parseResponse(resp); err != nil {
-		log.Error("kick invalid response", zap.Error(err))
+	input, err := p.Init(t.output)
+	if err != nil {
 		return err
 	}
+	t.input[p] = &pluginInput{ch: input, removed: make(chan struct{})}
 
 	return nil
 }
 
-func parseResponse(resp *http.Response) (TResponse, error) {
+// RemovePlugin stops sending updates to the plugin and closes its input
+// channel, then calls Close if it implements PluginCloser. An update being
+// delivered to the plugin is abandoned.
+func (t *Telegram) RemovePlugin(p Plugin) {
+	t.inputMu.Lock()
+	input, ok := t.input[p]
+	if ok {
+		delete(t.input, p)
+		close(input.removed)
+	}
+	t.inputMu.Unlock()
+	if !ok {
+		return
+	}
 
-	var tresp TResponse
-	if err := json.NewDecoder(resp.Body).Decode(&tresp); err != nil {
-		return tresp, fmt.Errorf("decoding response failed %s", err)
+	// no delivery starts once it is deleted, wait for the ones in progress
+	// before closing the channel they send to
+	input.sending.Wait()
+	close(input.ch)
+	t.closePlugin(p, input)
+}
+
+// SetPollTimeout enables long polling, telegram will hold getUpdates request
+// up to d until an update arrives. Zero disables long polling.
+func (t *Telegram) SetPollTimeout(d time.Duration) {
+	t.pollTimeout = d
+}
+
+// SetUpdateLimit sets how many updates are requested by each getUpdates,
+// between 1 and 100. The default is 100.
+func (t *Telegram) SetUpdateLimit(n int) {
+	if n < 1 {
+		n = 1
+	}
+	if n > 100 {
+		n = 100
+	}
+	t.updateLimit = n
+}
+
+// SetPollInterval sets the sleep between getUpdates when not long polling.
+// Each sleep is randomized by up to jitter fraction of d, 0.2 sleeps between
+// 0.8d and 1.2d. The default is 1 second with 0.2 jitter, d shorter than
+// 10ms is raised to 10ms.
+func (t *Telegram) SetPollInterval(d time.Duration, jitter float64) {
+	if d < minPollInterval {
+		d = minPollInterval
+	}
+	if jitter < 0 {
+		jitter = 0
+	}
+	if jitter > 1 {
+		jitter = 1
+	}
+	t.pollInterval = d
+	t.pollJitter = jitter
+}
+
+// pollDelay returns the randomized sleep before the next short poll
+func (t *Telegram) pollDelay() time.Duration {
+	spread := t.pollJitter * (2*rand.Float64() - 1)
+	return time.Duration(float64(t.pollInterval) * (1 + spread))
+}
+
+// maxPollBackoff caps the sleep between failed polls
+const maxPollBackoff = time.Minute
+
+// pollBackoff returns the sleep after the n-th consecutive failed poll, it
+// doubles from the poll interval up to maxPollBackoff
+func (t *Telegram) pollBackoff(n int) time.Duration {
+	d := t.pollInterval
+	for i := 1; i < n && d < maxPollBackoff; i++ {
+		d *= 2
+	}
+	if d > maxPollBackoff {
+		d = maxPollBackoff
+	}
+	return d
+}
+
+// sleep waits for d, it returns false when the bot is stopped before that
+func (t *Telegram) sleep(d time.Duration) bool {
+	select {
+	case <-t.quit:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// SetAllowedUpdates limits type of updates received from telegram such as
+// "message" or "callback_query". Calling it without types stops sending the
+// filter, telegram then keeps using the previous one.
+func (t *Telegram) SetAllowedUpdates(types ...string) {
+	if len(types) == 0 {
+		t.allowedUpdates = ""
+		return
+	}
+	b, _ := json.Marshal(types)
+	t.allowedUpdates = string(b)
+}
+
+// SetRawUpdateSink sets f to be called with the json of every update before
+// it is decoded, to log or record updates for debugging. f is called from
+// the polling goroutine and must not block.
+func (t *Telegram) SetRawUpdateSink(f func(json.RawMessage)) {
+	t.rawSink = f
+}
+
+// SetStrictFormat makes outgoing messages with unknown Format fail with
+// ErrInvalidFormat instead of being sent as plain text
+func (t *Telegram) SetStrictFormat(strict bool) {
+	t.strictFormat = strict
+}
+
+// SetCaptionAsText makes Text and Entities of incoming media messages without
+// text their caption, for plugins that only look at Text
+func (t *Telegram) SetCaptionAsText(enabled bool) {
+	t.captionText = enabled
+}
+
+// captionAsText moves the caption of m to its text if enabled
+func (t *Telegram) captionAsText(m *Message) {
+	if t.captionText && m.Text == "" {
+		m.Text, m.Entities = m.Caption, m.CaptionEntities
+	}
+}
+
+// SetBaseURL sends requests to a different bot API server such as a self
+// hosted one, u is like "http://localhost:8081" without the /bot<token> path.
+// Files are downloaded from the same server. It must be called before Start.
+func (t *Telegram) SetBaseURL(u string) {
+	u = strings.TrimSuffix(u, "/")
+	t.url = fmt.Sprintf("%s/bot%s", u, t.key)
+	t.fileURL = fmt.Sprintf("%s/file/bot%s", u, t.key)
+}
+
+// SetLogger sets the logger used by this instance
+func (t *Telegram) SetLogger(l zap.Logger) {
+	t.log = l.With(zap.String("module", "bot"))
+}
+
+// SetHTTPClient replaces the client used for every request to telegram. The
+// client timeout should be longer than the poll timeout.
+func (t *Telegram) SetHTTPClient(c *http.Client) {
+	t.client = c
+}
+
+// SetOffsetStore sets where the update offset is persisted, it is loaded on
+// Start and saved after each batch of updates
+func (t *Telegram) SetOffsetStore(s OffsetStore) {
+	t.offsets = s
+}
+
+// SetInputPolicy sets what happens to an update when a plugin input channel is
+// full. With Block, delivery waits up to timeout (until Stop when timeout is
+// 0) before the update is dropped for that plugin.
+func (t *Telegram) SetInputPolicy(p InputPolicy, timeout time.Duration) {
+	t.inputPolicy = p
+	t.inputTimeout = timeout
+}
+
+// SetDeadLetter sets where updates are forwarded when a plugin input channel is
+// full instead of being dropped, they are converted the same way as for
+// middleware. An update missed by several plugins is forwarded once. When ch is
+// also full the update is dropped.
+func (t *Telegram) SetDeadLetter(ch chan<- Message) {
+	t.deadLetters = ch
+}
+
+// Start consuming from telegram until Stop is called. It returns
+// ErrAlreadyStarted if it was started before, the error if telegram rejects
+// the API key, ErrConflict if another instance is polling with the same key
+// and nil once stopped.
+func (t *Telegram) Start() error {
+	return t.StartContext(context.Background())
+}
+
+// StartContext is like Start but stops consuming when ctx is done, as if Stop
+// was called
+func (t *Telegram) StartContext(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&t.started, 0, 1) {
+		return ErrAlreadyStarted
+	}
+
+	// ctx also cancels an in-flight getUpdates once Stop is called
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.closeQuit()
+		case <-t.quit:
+			cancel()
+		}
+	}()
+
+	if _, err := t.GetMe(); err != nil {
+		var terr *TelegramError
+		if errors.As(err, &terr) && terr.Code == http.StatusUnauthorized {
+			t.log.Error("invalid telegram API key, not starting", zap.Error(err))
+			return err
+		}
+	}
+
+	if t.offsets != nil {
+		offset, err := t.offsets.Load()
+		if err != nil {
+			t.log.Error("loading update offset failed", zap.Error(err))
+		} else {
+			atomic.StoreInt64(&t.lastUpdate, offset)
+		}
+	}
+	t.poolOutbox()
+	return t.poolInbox(ctx)
+}
+
+// Stop polling telegram for updates and wait until messages queued in the
+// outbox are sent or ctx is done, then close plugins implementing
+// PluginCloser. Albums still waiting for their items are delivered as is. It
+// is safe to call Stop more than once.
+func (t *Telegram) Stop(ctx context.Context) error {
+	t.flushAlbums()
+	t.closeQuit()
+
+	var err error
+	// nothing to wait for when the outbox never started
+	if atomic.LoadInt32(&t.outboxRun) == 1 {
+		select {
+		case <-t.outboxDone:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	t.closePluginsOnce.Do(t.closePlugins)
+
+	return err
+}
+
+// closePlugins calls Close of every plugin that has it. Close is called
+// without the lock so it may call RemovePlugin.
+func (t *Telegram) closePlugins() {
+	t.inputMu.RLock()
+	inputs := make(map[Plugin]*pluginInput, len(t.input))
+	for p, input := range t.input {
+		inputs[p] = input
+	}
+	t.inputMu.RUnlock()
+
+	for p, input := range inputs {
+		t.closePlugin(p, input)
+	}
+}
+
+// closePlugin calls Close of p if it has it, only once however it was closed
+func (t *Telegram) closePlugin(p Plugin, input *pluginInput) {
+	if !atomic.CompareAndSwapInt32(&input.closed, 0, 1) {
+		return
+	}
+	c, ok := p.(PluginCloser)
+	if !ok {
+		return
+	}
+	if err := c.Close(); err != nil {
+		t.log.Error("closing plugin failed", zap.String("plugin", p.Name()), zap.Error(err))
+	}
+}
+
+func (t *Telegram) closeQuit() {
+	t.quitOnce.Do(func() {
+		close(t.quit)
+	})
+}
+
+// Errors returns errors of background work such as polling updates and
+// sending from the outbox, each is an *OpError. Errors are skipped while the
+// channel is full so it never slows the bot.
+func (t *Telegram) Errors() <-chan error {
+	return t.errs
+}
+
+// reportError publishes err of op to Errors without blocking
+func (t *Telegram) reportError(op string, err error) {
+	select {
+	case t.errs <- &OpError{Op: op, Err: err}:
+	default:
+	}
+}
+
+func (t *Telegram) poolOutbox() {
+	// the outbox runs once even if it is asked again
+	if !atomic.CompareAndSwapInt32(&t.outboxRun, 0, 1) {
+		return
+	}
+
+	// fork incomming message, group by msg.Chat.ID to the workers
+	inChs := make([]chan outgoing, OutboxWorker)
+	for i := 0; i < OutboxWorker; i++ {
+		inChs[i] = make(chan outgoing)
+	}
+
+	go func() {
+		// closing the worker channels lets the workers finish what is queued
+		defer func() {
+			for _, ch := range inChs {
+				close(ch)
+			}
+		}()
+
+		h := fnv.New32a()
+		dispatch := func(m interface{}) {
+			out, err := t.newOutgoing(m)
+			if err != nil {
+				t.log.Error("invalid outgoing message", zap.Error(err), zap.Object("msg", m))
+				t.reportError("outbox", err)
+				return
+			}
+			// all parts of a message go to the same worker to keep their order
+			for _, o := range out {
+				h.Reset()
+				h.Write([]byte(o.chatID))
+				i := int(h.Sum32()) % OutboxWorker
+				inChs[i] <- o
+			}
+		}
+		for {
+			select {
+			case m := <-t.output:
+				t.waitResumed()
+				dispatch(m)
+			case <-t.quit:
+				// drain messages that are already queued
+				for {
+					select {
+					case m := <-t.output:
+						dispatch(m)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(OutboxWorker)
+	go func() {
+		wg.Wait()
+		close(t.outboxDone)
+	}()
+
+	for i := 0; i < OutboxWorker; i++ {
+		go func(i int) {
+			defer wg.Done()
+			t.runWorker(inChs[i], i)
+		}(i)
+	}
+}
+
+// runWorker sends messages from in until it is closed. A message to a chat
+// over its rate limit is held back while messages to other chats are sent, so
+// one busy chat doesn't delay the others. Messages to the same chat keep
+// their order. At most OutboxBufferSize messages are held, then in is not
+// read until some are sent.
+func (t *Telegram) runWorker(in <-chan outgoing, worker int) {
+	var pending []outgoing
+	for in != nil || len(pending) > 0 {
+		var wait time.Duration
+		pending, wait = t.sendReady(pending, worker)
+
+		recv := in
+		if len(pending) >= OutboxBufferSize {
+			recv = nil
+		}
+		var next <-chan time.Time
+		if len(pending) > 0 {
+			next = time.After(wait)
+		}
+		select {
+		case o, ok := <-recv:
+			if !ok {
+				in = nil
+				continue
+			}
+			pending = append(pending, o)
+		case <-next:
+		case <-t.quit:
+			// stopping, send what is held without waiting for the limiter
+			if len(pending) > 0 {
+				t.sendReady(pending, worker)
+				pending = nil
+			}
+			for o := range in {
+				t.sendReady([]outgoing{o}, worker)
+			}
+			return
+		}
+	}
+}
+
+// sendReady sends pending messages whose chat is within the rate limit and
+// returns the ones left with how long until the next may be sent. Once the bot
+// is stopping every message is sent.
+func (t *Telegram) sendReady(pending []outgoing, worker int) ([]outgoing, time.Duration) {
+	var wait time.Duration
+	var held map[string]bool
+	stopping := t.stopping()
+	rest := pending[:0]
+	for _, o := range pending {
+		if !held[o.chatID] {
+			d := time.Duration(0)
+			if !stopping {
+				d = t.limiter.reserve(o.chatID, time.Now())
+			}
+			if d == 0 {
+				t.send(o, worker, !stopping)
+				continue
+			}
+			if wait == 0 || d < wait {
+				wait = d
+			}
+			if held == nil {
+				held = make(map[string]bool)
+			}
+			held[o.chatID] = true
+		}
+		rest = append(rest, o)
+	}
+	return rest, wait
+}
+
+// stopping reports whether Stop was called
+func (t *Telegram) stopping() bool {
+	select {
+	case <-t.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// PauseOutbox stops sending messages until ResumeOutbox, updates are still
+// received. Messages of plugins are held in the outbox buffer of
+// OutboxBufferSize, plugins then block on sending. A message that was being
+// sent when pausing is still sent. Stop sends held messages.
+func (t *Telegram) PauseOutbox() {
+	t.pauseMu.Lock()
+	defer t.pauseMu.Unlock()
+	if t.resumed == nil {
+		t.resumed = make(chan struct{})
+	}
+}
+
+// ResumeOutbox sends messages held since PauseOutbox in the order they were
+// queued
+func (t *Telegram) ResumeOutbox() {
+	t.pauseMu.Lock()
+	defer t.pauseMu.Unlock()
+	if t.resumed != nil {
+		close(t.resumed)
+		t.resumed = nil
+	}
+}
+
+// waitResumed blocks while the outbox is paused
+func (t *Telegram) waitResumed() {
+	t.pauseMu.Lock()
+	resumed := t.resumed
+	t.pauseMu.Unlock()
+	if resumed == nil {
+		return
+	}
+	select {
+	case <-resumed:
+	case <-t.quit:
+	}
+}
+
+// send posts outgoing message to telegram and reports the result to the
+// sender if it asked for it. reserved is true when the worker already took the
+// rate limit token of the first attempt.
+func (t *Telegram) send(o outgoing, worker int, reserved bool) {
+	id, err := t.post(o, worker, reserved)
+	if err != nil {
+		t.reportError(o.method, err)
+	}
+	if o.result == nil {
+		return
+	}
+	select {
+	case o.result <- SendResult{MessageID: id, Err: err}:
+	default:
+		t.log.Warn("send result channel full, skipping result", zap.String("ChatID", o.chatID), zap.Int("worker", worker))
+	}
+}
+
+// post sends o to telegram, retrying according to o.retry, and returns the
+// message_id of the sent message. worker is only logged, it is -1 when the
+// message is not sent by the outbox. Each attempt waits for the rate limiter
+// unless reserved is set, then the first one goes out right away.
+func (t *Telegram) post(o outgoing, worker int, reserved bool) (int64, error) {
+	m := o.msg
+	t.log.Debug("processing message", zap.String("chanID", o.chatID), zap.Int("worker", worker))
+	if !o.discardAfter.IsZero() && time.Now().After(o.discardAfter) {
+		t.stats.msgDiscardedCount.Inc(1)
+		t.log.Warn("discarded message", zap.Object("msg", m), zap.Int("worker", worker))
+		return 0, ErrMessageDiscarded
+	}
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(o.payload); err != nil {
+		t.log.Error("encoding message", zap.Error(err))
+		return 0, err
+	}
+	started := time.Now()
+	jsonMsg := b.String()
+
+	var tresp TResponse
+	var err error
+	retries := o.retry
+	limited := 0
+	for {
+		if retries < 0 {
+			if o.retry > 0 {
+				metrics.GetOrRegisterCounter(fmt.Sprintf("telegram.%s.droppedAfter.%d", o.method, o.retry), t.metrics).Inc(1)
+			}
+			t.log.Error("message dropped, not retrying", zap.Object("msg", m), zap.Int("worker", worker))
+			t.stats.msgDroppedCount.Inc(1)
+			return 0, err
+		}
+
+		if !o.discardAfter.IsZero() && time.Now().After(o.discardAfter) {
+			t.log.Error("message dropped, discarded", zap.Object("msg", m), zap.Int("worker", worker))
+			t.stats.msgDiscardedCount.Inc(1)
+			return 0, ErrMessageDiscarded
+		}
+		retries--
+
+		if reserved {
+			reserved = false
+		} else {
+			t.limiter.wait(o.chatID, t.quit)
+		}
+		var resp *http.Response
+		latency := metrics.GetOrRegisterTimer(fmt.Sprintf("telegram.%s.latency", o.method), t.metrics)
+		resp, err = t.doRetry(o.method, false, func() (*http.Response, error) {
+			defer latency.UpdateSince(time.Now())
+			return t.client.Post(fmt.Sprintf("%s/%s", t.url, o.method), jsonContentType, bytes.NewReader(b.Bytes()))
+		})
+		if err != nil {
+			t.stats.msgFailedCount.Inc(1)
+			// check for timeout
+			if netError, ok := err.(net.Error); ok && netError.Timeout() {
+				t.stats.msgTimeoutCount.Inc(1)
+				t.log.Error(o.method+" timeout", zap.String("ChatID", o.chatID), zap.Error(err), zap.Int("retries", retries), zap.Int("worker", worker))
+				continue
+			}
+
+			// unknown error
+			t.stats.msgDroppedCount.Inc(1)
+			t.log.Error(o.method+" failed, dropped", zap.String("ChatID", o.chatID), zap.Error(err), zap.Object("msg", m), zap.Int("worker", worker))
+			return 0, err
+		}
+		metrics.GetOrRegisterCounter(fmt.Sprintf("telegram.%s.http.%d", o.method, resp.StatusCode), t.metrics).Inc(1)
+
+		if resp.StatusCode == 429 { // rate limited by telegram
+			t.stats.msgFailedCount.Inc(1)
+			tresp, err = parseResponse(resp)
+			resp.Body.Close()
+			limited++
+			if limited > maxRateLimitWaits {
+				t.stats.msgDroppedCount.Inc(1)
+				t.log.Error(o.method+" rate limited, dropped", zap.String("ChatID", o.chatID), zap.Error(err), zap.Int("worker", worker))
+				return 0, err
+			}
+			d := retryAfter(resp, tresp)
+			t.log.Warn(o.method+" rate limited, delayed", zap.String("ChatID", o.chatID), zap.String("delay", d.String()), zap.Error(err), zap.Int("worker", worker))
+			select {
+			case <-t.quit:
+				// don't hold Stop for the rate limit
+				t.stats.msgDroppedCount.Inc(1)
+				t.log.Error(o.method+" rate limited while stopping, dropped", zap.String("ChatID", o.chatID), zap.Int("worker", worker))
+				return 0, ErrStopped
+			case <-time.After(d):
+			}
+			// waiting for rate limit does not count as retry
+			retries++
+			continue
+		}
+
+		tresp, err = parseResponse(resp)
+		resp.Body.Close()
+		if errors.Is(err, ErrTransient) {
+			t.stats.msgFailedCount.Inc(1)
+			t.log.Error(o.method+" transient failure", zap.String("ChatID", o.chatID), zap.Error(err), zap.Int("retries", retries), zap.Int("worker", worker))
+			continue
+		}
+		break
+	}
+
+	attempt := retries - o.retry + 1
+	metrics.GetOrRegisterCounter(fmt.Sprintf("telegram.%s.retry.%d", o.method, attempt), t.metrics).Inc(1)
+
+	t.stats.sendMessageDuration.UpdateSince(started)
+	if err != nil {
+		t.log.Error(o.method+" failed", zap.String("ChatID", o.chatID), zap.Error(err), zap.Object("msg", jsonMsg), zap.Int("worker", worker))
+		return 0, err
+	}
+
+	var sent TMessage
+	if err := json.Unmarshal(tresp.Result, &sent); err != nil {
+		t.log.Error("parsing "+o.method+" response failed", zap.String("ChatID", o.chatID), zap.Error(err), zap.Int("worker", worker))
+		return 0, err
+	}
+
+	return sent.MessageID, nil
+}
+
+// poolInbox polls telegram for updates until quit, it stops early with
+// ErrConflict since polling would never succeed
+func (t *Telegram) poolInbox(ctx context.Context) error {
+	// consecutive failed polls, backing off while telegram is unreachable
+	failures := 0
+	for {
+		select {
+		case <-t.quit:
+			return nil
+		default:
+			started := time.Now()
+			resp, err := t.doRetry("getUpdates", true, func() (*http.Response, error) {
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.updatesURL(), nil)
+				if err != nil {
+					return nil, err
+				}
+				defer t.stats.updateLatency.UpdateSince(time.Now())
+				return t.client.Do(req)
+			})
+			if err != nil {
+				t.log.Error("getUpdates failed", zap.Error(err))
+				t.reportError("getUpdates", err)
+				t.stats.updateDuration.UpdateSince(started)
+				failures++
+				if !t.sleep(t.pollBackoff(failures)) {
+					return nil
+				}
+				continue
+			}
+			t.stats.updateDuration.UpdateSince(started)
+			t.stats.updateCount.Inc(1)
+			metrics.GetOrRegisterCounter(fmt.Sprintf("telegram.getUpdates.http.%d", resp.StatusCode), t.metrics).Inc(1)
+
+			nMsg, err := t.parseInbox(resp)
+			if errors.Is(err, ErrConflict) {
+				t.log.Error("another instance is getting updates with the same API key, stopped polling", zap.Error(err))
+				t.reportError("getUpdates", err)
+				return err
+			}
+			if err != nil {
+				t.log.Error("parsing updates response failed", zap.Error(err))
+				t.reportError("getUpdates", err)
+				failures++
+				if !t.sleep(t.pollBackoff(failures)) {
+					return nil
+				}
+				continue
+			}
+			failures = 0
+			t.stats.msgPerUpdateCount.Inc(int64(nMsg))
+			if nMsg > 0 && t.offsets != nil {
+				if err := t.offsets.Save(atomic.LoadInt64(&t.lastUpdate)); err != nil {
+					t.log.Error("saving update offset failed", zap.Error(err))
+				}
+			}
+			// long polling already blocks on the server side, a full batch
+			// means more updates are waiting
+			if nMsg < t.updateLimit && t.pollTimeout <= 0 {
+				if !t.sleep(t.pollDelay()) {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (t *Telegram) updatesURL() string {
+	u := fmt.Sprintf("%s/getUpdates?offset=%d&limit=%d", t.url, atomic.LoadInt64(&t.lastUpdate)+1, t.updateLimit)
+	if t.pollTimeout > 0 {
+		u += fmt.Sprintf("&timeout=%d", int64(t.pollTimeout/time.Second))
+	}
+	if t.allowedUpdates != "" {
+		u += "&allowed_updates=" + url.QueryEscape(t.allowedUpdates)
+	}
+	return u
+}
+
+func (t *Telegram) parseInbox(resp *http.Response) (int, error) {
+	defer resp.Body.Close()
+
+	receivedAt := time.Now()
+	tresp, err := decodeResponse(resp)
+	if err != nil {
+		return 0, err
+	}
+
+	if !tresp.Ok {
+		if tresp.ErrorCode == http.StatusConflict {
+			return 0, fmt.Errorf("%w: %s", ErrConflict, tresp.Description)
+		}
+		return 0, &TelegramError{Code: tresp.ErrorCode, Description: tresp.Description}
+	}
+
+	atomic.StoreInt64(&t.lastPoll, receivedAt.UnixNano())
+
+	var results []json.RawMessage
+	json.Unmarshal(tresp.Result, &results)
+	for _, raw := range results {
+		if t.rawSink != nil {
+			t.rawSink(raw)
+		}
+		var update TUpdate
+		if err := json.Unmarshal(raw, &update); err != nil {
+			// its update id can't be trusted to move the offset
+			t.log.Error("decoding update failed, skipped", zap.Error(err))
+			t.stats.updateMalformedCount.Inc(1)
+			continue
+		}
+		atomic.StoreInt64(&t.lastUpdate, update.UpdateID)
+		t.dispatchUpdate(update, receivedAt)
+	}
+
+	return len(results), nil
+}
+
+// GetMe returns the bot user, the result is cached after the first success
+func (t *Telegram) GetMe() (TUser, error) {
+	t.meMu.Lock()
+	defer t.meMu.Unlock()
+	if t.me != nil {
+		return *t.me, nil
+	}
+
+	tresp, err := t.callJSON("getMe", struct{}{})
+	if err != nil {
+		t.log.Error("getMe failed", zap.Error(err))
+		t.meFailed = time.Now()
+		return TUser{}, err
+	}
+
+	var me TUser
+	if err := json.Unmarshal(tresp.Result, &me); err != nil {
+		return TUser{}, err
+	}
+	t.me = &me
+
+	return me, nil
+}
+
+// SendMessage sends m directly without going through the outbox, retrying
+// like the outbox does. When the text is split the parts are sent in order and
+// the ID of the last one is returned.
+func (t *Telegram) SendMessage(m Message) (sentID int64, err error) {
+	out, err := t.newOutgoing(m)
+	if err != nil {
+		return 0, err
+	}
+	for _, o := range out {
+		if sentID, err = t.post(o, -1, false); err != nil {
+			return 0, err
+		}
+	}
+
+	return sentID, nil
+}
+
+// SendMessageWith is like SendMessage for a text with the given options
+func (t *Telegram) SendMessageWith(chatID, text string, opts SendOptions) (int64, error) {
+	return t.SendMessage(Message{
+		Chat:                  Chat{ID: chatID},
+		Text:                  text,
+		Format:                opts.Format,
+		ReplyMessageID:        opts.ReplyMessageID,
+		MessageThreadID:       opts.MessageThreadID,
+		InlineKeyboard:        opts.InlineKeyboard,
+		ReplyKeyboard:         opts.ReplyKeyboard,
+		RemoveKeyboard:        opts.RemoveKeyboard,
+		DisableWebPagePreview: opts.DisableWebPagePreview,
+		DisableNotification:   opts.DisableNotification,
+		ProtectContent:        opts.ProtectContent,
+		Retry:                 opts.Retry,
+		DiscardAfter:          opts.DiscardAfter,
+	})
+}
+
+// Broadcast sends m to every chat of chatIDs one by one, paced by the outbox
+// rate limit. It returns an error for each chat in the same order, nil when
+// the message was sent. Chats which blocked or removed the bot fail with
+// ErrBotBlocked so they can be pruned.
+func (t *Telegram) Broadcast(chatIDs []string, m Message) []error {
+	errs := make([]error, len(chatIDs))
+	for i, id := range chatIDs {
+		m.Chat = Chat{ID: id}
+		if _, err := t.SendMessage(m); err != nil {
+			errs[i] = blockedError(err)
+		}
+	}
+
+	return errs
+}
+
+// SendPhoto sends photo directly without going through the outbox
+func (t *Telegram) SendPhoto(p PhotoMessage) error {
+	if _, err := t.callJSON("sendPhoto", newTOutPhoto(p)); err != nil {
+		t.log.Error("sendPhoto failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// dispatchUpdate converts update to bot model and sends it to plugins, it is
+// shared by polling and webhook
+func (t *Telegram) dispatchUpdate(u TUpdate, receivedAt time.Time) {
+	metrics.GetOrRegisterCounter("telegram.updates.type."+updateType(u), t.metrics).Inc(1)
+
+	var msg interface{}
+	var msgID string
+	switch {
+	case u.CallbackQuery != nil:
+		q := u.CallbackQuery
+		callback := CallbackQuery{
+			ID:              q.ID,
+			From:            newUser(q.From),
+			Data:            q.Data,
+			InlineMessageID: q.InlineMessageID,
+			ReceivedAt:      receivedAt,
+		}
+		if q.Message != nil {
+			message := newMessage(*q.Message, nil, receivedAt)
+			callback.Message = &message
+		}
+		msg, msgID = &callback, q.ID
+	case u.InlineQuery != nil:
+		q := u.InlineQuery
+		query := InlineQuery{
+			ID:         q.ID,
+			From:       newUser(q.From),
+			Query:      q.Query,
+			Offset:     q.Offset,
+			ReceivedAt: receivedAt,
+		}
+		msg, msgID = &query, q.ID
+	case u.MyChatMember != nil:
+		m := u.MyChatMember
+		update := BotChatMemberUpdate{
+			Chat:       newChat(m.Chat),
+			From:       newUser(m.From),
+			Date:       time.Unix(m.Date, 0),
+			OldStatus:  ChatMemberStatus(m.OldChatMember.Status),
+			NewStatus:  ChatMemberStatus(m.NewChatMember.Status),
+			ReceivedAt: receivedAt,
+		}
+		msg, msgID = &update, strconv.FormatInt(u.UpdateID, 10)
+	case u.PollAnswer != nil:
+		answer := PollAnswer{
+			PollID:     u.PollAnswer.PollID,
+			OptionIDs:  u.PollAnswer.OptionIDs,
+			ReceivedAt: receivedAt,
+		}
+		if u.PollAnswer.User != nil {
+			answer.User = newUser(*u.PollAnswer.User)
+		}
+		msg, msgID = &answer, answer.PollID
+	case len(u.Message) > 0 || len(u.ChannelPost) > 0:
+		raw := u.Message
+		if len(raw) == 0 {
+			raw = u.ChannelPost
+		}
+		var m TMessage
+		json.Unmarshal(raw, &m)
+		message := newMessage(m, raw, receivedAt)
+		t.captionAsText(&message)
+		t.setCommand(&message)
+		t.stats.updateLag.Update(int64(receivedAt.Sub(message.Date) / time.Millisecond))
+		if message.MediaGroupID != "" && t.albumWindow > 0 {
+			t.bufferAlbum(message)
+			return
+		}
+		switch {
+		case m.MigrateToChatID != nil:
+			newChanID := strconv.FormatInt(*(m.MigrateToChatID), 10)
+			chanMigratedMsg := ChannelMigratedMessage{
+				Message:    message,
+				FromID:     message.Chat.ID,
+				ToID:       newChanID,
+				ReceivedAt: receivedAt,
+			}
+			msg = &chanMigratedMsg
+		case len(m.NewChatMembers) > 0:
+			joined := ChatMemberJoinedMessage{Message: message}
+			for _, u := range m.NewChatMembers {
+				joined.Members = append(joined.Members, newUser(u))
+			}
+			msg = &joined
+		case m.LeftChatMember != nil:
+			left := ChatMemberLeftMessage{
+				Message: message,
+				Member:  newUser(*m.LeftChatMember),
+			}
+			msg = &left
+		default:
+			msg = &message
+		}
+		msgID = message.ID
+	case len(u.EditedMessage) > 0 || len(u.EditedChannelPost) > 0:
+		raw := u.EditedMessage
+		if len(raw) == 0 {
+			raw = u.EditedChannelPost
+		}
+		var m TMessage
+		json.Unmarshal(raw, &m)
+		edited := EditedMessage{
+			Message:  newMessage(m, raw, receivedAt),
+			EditDate: time.Unix(m.EditDate, 0),
+		}
+		t.captionAsText(&edited.Message)
+		t.setCommand(&edited.Message)
+		msg, msgID = &edited, edited.ID
+	default:
+		t.log.Debug("unsupported update", zap.Int64("updateID", u.UpdateID))
+		return
+	}
+
+	t.publish(msg, msgID)
+}
+
+// updateType returns the name of the update field that is set, such as
+// "message" or "callback_query"
+func updateType(u TUpdate) string {
+	switch {
+	case u.CallbackQuery != nil:
+		return "callback_query"
+	case u.InlineQuery != nil:
+		return "inline_query"
+	case u.MyChatMember != nil:
+		return "my_chat_member"
+	case u.PollAnswer != nil:
+		return "poll_answer"
+	case len(u.Message) > 0:
+		return "message"
+	case len(u.ChannelPost) > 0:
+		return "channel_post"
+	case len(u.EditedMessage) > 0:
+		return "edited_message"
+	case len(u.EditedChannelPost) > 0:
+		return "edited_channel_post"
+	default:
+		return "unknown"
+	}
+}
+
+// publish runs the middleware on msg and sends it to every plugin
+func (t *Telegram) publish(msg interface{}, msgID string) {
+	t.log.Debug("update", zap.Object("msg", msg))
+	if !t.allow(msg) {
+		t.log.Debug("update dropped by middleware", zap.String("msgID", msgID))
+		return
+	}
+
+	// deliver without the lock so a blocked plugin doesn't hold up AddPlugin
+	// and RemovePlugin
+	t.inputMu.RLock()
+	plugins := make([]Plugin, 0, len(t.input))
+	inputs := make([]*pluginInput, 0, len(t.input))
+	for plugin, input := range t.input {
+		input.sending.Add(1)
+		plugins = append(plugins, plugin)
+		inputs = append(inputs, input)
+	}
+	t.inputMu.RUnlock()
+
+	deadLettered := false
+	for i, input := range inputs {
+		plugin := plugins[i]
+		ok := t.deliver(input, msg)
+		input.sending.Done()
+		if !ok {
+			// forward once however many plugins had no room for it
+			if deadLettered || t.deadLetter(msg) {
+				deadLettered = true
+				metrics.GetOrRegisterCounter(fmt.Sprintf("telegram.input.deadLetter.%s", plugin.Name()), t.metrics).Inc(1)
+				continue
+			}
+			metrics.GetOrRegisterCounter(fmt.Sprintf("telegram.input.dropped.%s", plugin.Name()), t.metrics).Inc(1)
+			t.log.Warn("input channel full, skipping message", zap.String("plugin", plugin.Name()), zap.String("msgID", msgID))
+		}
+	}
+}
+
+// deadLetter forwards msg a plugin had no room for to the dead letter channel,
+// returns false if there is none or it is full
+func (t *Telegram) deadLetter(msg interface{}) bool {
+	if t.deadLetters == nil {
+		return false
+	}
+	m, ok := messageOf(msg)
+	if !ok {
+		return false
+	}
+
+	select {
+	case t.deadLetters <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver sends msg to plugin input channel according to the input policy,
+// returns false if the message was dropped. A plugin removed meanwhile doesn't
+// want it anymore, that is not a drop.
+func (t *Telegram) deliver(input *pluginInput, msg interface{}) bool {
+	if t.inputPolicy == Block {
+		// a nil timeout channel blocks until delivered or stopped
+		var timeout <-chan time.Time
+		if t.inputTimeout > 0 {
+			timer := time.NewTimer(t.inputTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case input.ch <- msg:
+			return true
+		case <-input.removed:
+			return true
+		case <-timeout:
+			return false
+		case <-t.quit:
+			return false
+		}
+	}
+
+	select {
+	case input.ch <- msg:
+		return true
+	case <-input.removed:
+		return true
+	default:
+		return false
+	}
+}
+
+func newMessage(m TMessage, raw json.RawMessage, receivedAt time.Time) Message {
+	message := Message{
+		ID:              strconv.FormatInt(m.MessageID, 10),
+		Date:            time.Unix(m.Date, 0),
+		Chat:            newChat(m.Chat),
+		Text:            m.Text,
+		Entities:        newEntities(m.Text, m.Entities),
+		Caption:         m.Caption,
+		CaptionEntities: newEntities(m.Caption, m.CaptionEntities),
+		Photo:           newPhotos(m.Photo),
+		Video:           newVideo(m.Video),
+		Animation:       newVideo(m.Animation),
+		MediaGroupID:    m.MediaGroupID,
+		MessageThreadID: m.MessageThreadID,
+		ReceivedAt:      receivedAt,
+		Raw:             raw,
+	}
+	message.Forward = newForwardInfo(m)
+	if m.Contact != nil {
+		message.Contact = &Contact{
+			PhoneNumber: m.Contact.PhoneNumber,
+			FirstName:   m.Contact.FirstName,
+			LastName:    m.Contact.LastName,
+		}
+		if m.Contact.UserID != 0 {
+			message.Contact.UserID = strconv.FormatInt(m.Contact.UserID, 10)
+		}
+	}
+	if m.Location != nil {
+		message.Location = &Location{Latitude: m.Location.Latitude, Longitude: m.Location.Longitude}
+	}
+	// channel posts have no sender
+	if m.From != nil {
+		message.From = newUser(*m.From)
+	}
+	if m.ReplyTo != nil {
+		// telegram only nest one level, make sure we never recurse further
+		replyTo := *m.ReplyTo
+		replyTo.ReplyTo = nil
+		reply := newMessage(replyTo, nil, receivedAt)
+		message.ReplyTo = &reply
+	}
+
+	return message
+}
+
+// newForwardInfo returns where m was forwarded from, preferring
+// forward_origin of newer API versions over the forward_* fields
+func newForwardInfo(m TMessage) *ForwardInfo {
+	from, fromChat, date := m.ForwardFrom, m.ForwardFromChat, m.ForwardDate
+	var senderName string
+	if o := m.ForwardOrigin; o != nil {
+		from, fromChat, date, senderName = o.SenderUser, o.Chat, o.Date, o.SenderUserName
+		if fromChat == nil {
+			fromChat = o.SenderChat
+		}
+	}
+	if date == 0 {
+		return nil
+	}
+
+	info := ForwardInfo{SenderName: senderName, Date: time.Unix(date, 0)}
+	if from != nil {
+		user := newUser(*from)
+		info.From = &user
+	}
+	if fromChat != nil {
+		chat := newChat(*fromChat)
+		info.FromChat = &chat
+	}
+	return &info
+}
+
+func newVideo(v *TVideo) *Video {
+	if v == nil {
+		return nil
+	}
+	return &Video{
+		FileID:   v.FileID,
+		Width:    v.Width,
+		Height:   v.Height,
+		Duration: time.Duration(v.Duration) * time.Second,
+		MimeType: v.MimeType,
+		FileSize: v.FileSize,
+	}
+}
+
+func newChat(c TChat) Chat {
+	return Chat{
+		ID:       strconv.FormatInt(c.ID, 10),
+		Type:     TChatTypeMap[c.Type],
+		Title:    c.Title,
+		Username: c.Username,
+	}
+}
+
+func newUser(u TUser) User {
+	return User{
+		ID:           strconv.FormatInt(u.ID, 10),
+		IsBot:        u.IsBot,
+		FirstName:    u.FirstName,
+		LastName:     u.LastName,
+		Username:     u.Username,
+		LanguageCode: u.LanguageCode,
+	}
+}
+
+func newPhotos(sizes []TPhotoSize) []Photo {
+	if len(sizes) == 0 {
+		return nil
+	}
+	photos := make([]Photo, len(sizes))
+	for i, p := range sizes {
+		photos[i] = Photo{
+			FileID:   p.FileID,
+			Width:    p.Width,
+			Height:   p.Height,
+			FileSize: p.FileSize,
+		}
+	}
+	return photos
+}
+
+// GetFile returns information needed to download a file by its file_id
+func (t *Telegram) GetFile(fileID string) (TFile, error) {
+	var file TFile
+	tresp, err := t.callJSON("getFile", map[string]string{"file_id": fileID})
+	if err != nil {
+		t.log.Error("getFile failed", zap.Error(err))
+		return file, err
+	}
+
+	if err := json.Unmarshal(tresp.Result, &file); err != nil {
+		return file, err
+	}
+
+	return file, nil
+}
+
+// DownloadFile writes content of file at filePath (TFile.FilePath) to w
+func (t *Telegram) DownloadFile(filePath string, w io.Writer) error {
+	resp, err := t.client.Get(fmt.Sprintf("%s/%s", t.fileURL, filePath))
+	if err != nil {
+		t.log.Error("download file failed", zap.Error(err))
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download file failed with status %d", resp.StatusCode)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// AnswerCallbackQuery acknowledges a CallbackQuery. Text is shown to the user
+// as a notification or as an alert when showAlert is true, empty text only
+// dismisses the progress indicator.
+func (t *Telegram) AnswerCallbackQuery(id string, text string, showAlert bool) error {
+	return t.AnswerCallbackQueryWith(id, CallbackAnswer{Text: text, ShowAlert: showAlert})
+}
+
+// AnswerCallbackQueryWith acknowledges a CallbackQuery with the given answer.
+// Telegram only opens a URL of a game or a t.me link that starts the bot,
+// other URLs are sent anyway but likely rejected.
+func (t *Telegram) AnswerCallbackQueryWith(id string, a CallbackAnswer) error {
+	if a.URL != "" && !strings.HasPrefix(a.URL, "https://t.me/") && !strings.HasPrefix(a.URL, "t.me/") {
+		t.log.Warn("callback answer url is not a t.me link, telegram may reject it", zap.String("url", a.URL))
+	}
+	answer := TAnswerCallbackQuery{
+		CallbackQueryID: id,
+		Text:            a.Text,
+		ShowAlert:       a.ShowAlert,
+		URL:             a.URL,
+		CacheTime:       int(a.CacheTime / time.Second),
+	}
+	if _, err := t.callJSON("answerCallbackQuery", answer); err != nil {
+		t.log.Error("answerCallbackQuery failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// AnswerInlineQuery sends results of an InlineQuery, the user picks one of
+// them to send to the chat. At most 50 results are allowed.
+func (t *Telegram) AnswerInlineQuery(id string, results []InlineQueryResult) error {
+	articles := make([]TInlineQueryResultArticle, len(results))
+	for i, r := range results {
+		articles[i] = TInlineQueryResultArticle{
+			Type:  "article",
+			ID:    r.ID,
+			Title: r.Title,
+			InputMessageContent: TInputTextMessageContent{
+				MessageText: r.Text,
+				ParseMode:   string(r.Format),
+			},
+			URL:         r.URL,
+			Description: r.Description,
+		}
+	}
+
+	req := struct {
+		InlineQueryID string                      `json:"inline_query_id"`
+		Results       []TInlineQueryResultArticle `json:"results"`
+	}{id, articles}
+	if _, err := t.callJSON("answerInlineQuery", req); err != nil {
+		t.log.Error("answerInlineQuery failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// EditMessageText changes text of a message previously sent by the bot. It
+// returns ErrMessageNotModified when the message already has the same text.
+func (t *Telegram) EditMessageText(chatID string, messageID int64, text string, parseMode MessageFormat) error {
+	return t.editMessageText(TEditMessageText{
+		ChatID:    chatID,
+		MessageID: messageID,
+		Text:      text,
+		ParseMode: string(parseMode),
+	})
+}
+
+// EditInlineMessageText changes text of a message sent via inline mode
+func (t *Telegram) EditInlineMessageText(inlineMessageID string, text string, parseMode MessageFormat) error {
+	return t.editMessageText(TEditMessageText{
+		InlineMessageID: inlineMessageID,
+		Text:            text,
+		ParseMode:       string(parseMode),
+	})
+}
+
+func (t *Telegram) editMessageText(edit TEditMessageText) error {
+	tresp, err := t.callJSON("editMessageText", edit)
+	if err != nil {
+		if isNotModified(tresp) {
+			return ErrMessageNotModified
+		}
+		t.log.Error("editMessageText failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// EditMessageReplyMarkup replaces the inline keyboard of a message previously
+// sent by the bot, nil markup removes the keyboard. It returns
+// ErrMessageNotModified when the message already has the same keyboard.
+func (t *Telegram) EditMessageReplyMarkup(chatID string, messageID int64, markup InlineKeyboard) error {
+	req := struct {
+		ChatID      string                 `json:"chat_id"`
+		MessageID   int64                  `json:"message_id"`
+		ReplyMarkup *TInlineKeyboardMarkup `json:"reply_markup,omitempty"`
+	}{ChatID: chatID, MessageID: messageID}
+	if len(markup) > 0 {
+		req.ReplyMarkup = newTInlineKeyboardMarkup(markup)
+	}
+	tresp, err := t.callJSON("editMessageReplyMarkup", req)
+	if err != nil {
+		if isNotModified(tresp) {
+			return ErrMessageNotModified
+		}
+		t.log.Error("editMessageReplyMarkup failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// DeleteMessage deletes a message from chat
+func (t *Telegram) DeleteMessage(chatID string, messageID int64) error {
+	req := struct {
+		ChatID    string `json:"chat_id"`
+		MessageID int64  `json:"message_id"`
+	}{chatID, messageID}
+	tresp, err := t.callJSON("deleteMessage", req)
+	if err != nil {
+		if !tresp.Ok && strings.Contains(tresp.Description, "message can't be deleted") {
+			return ErrMessageCantBeDeleted
+		}
+		t.log.Error("deleteMessage failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// SendChatAction shows action to the users of a chat for a few seconds or
+// until the bot sends a message
+func (t *Telegram) SendChatAction(chatID string, action ChatAction) error {
+	req := struct {
+		ChatID string     `json:"chat_id"`
+		Action ChatAction `json:"action"`
+	}{chatID, action}
+	if _, err := t.callJSON("sendChatAction", req); err != nil {
+		t.log.Error("sendChatAction failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// KeepChatAction keeps sending action to a chat until stop is called
+func (t *Telegram) KeepChatAction(chatID string, action ChatAction) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(chatActionInterval)
+		defer ticker.Stop()
+		for {
+			t.SendChatAction(chatID, action)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+// ForwardMessage forwards a message from one chat to another
+func (t *Telegram) ForwardMessage(toChatID, fromChatID string, messageID int64) error {
+	req := TForwardMessage{ChatID: toChatID, FromChatID: fromChatID, MessageID: messageID}
+	if _, err := t.callJSON("forwardMessage", req); err != nil {
+		t.log.Error("forwardMessage failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// CopyMessage is like ForwardMessage but the copy has no link to the original
+// message
+func (t *Telegram) CopyMessage(toChatID, fromChatID string, messageID int64) error {
+	req := TForwardMessage{ChatID: toChatID, FromChatID: fromChatID, MessageID: messageID}
+	if _, err := t.callJSON("copyMessage", req); err != nil {
+		t.log.Error("copyMessage failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// SetMyCommands replaces the list of commands shown in the bot menu
+func (t *Telegram) SetMyCommands(cmds []BotCommand) error {
+	for _, cmd := range cmds {
+		if !botCommandRe.MatchString(cmd.Command) {
+			return fmt.Errorf("invalid command %q, must be 1-32 characters of lowercase letters, digits or underscores", cmd.Command)
+		}
+	}
+
+	req := struct {
+		Commands []BotCommand `json:"commands"`
+	}{cmds}
+	if _, err := t.callJSON("setMyCommands", req); err != nil {
+		t.log.Error("setMyCommands failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// GetChat returns up to date information about a chat
+func (t *Telegram) GetChat(chatID string) (TChat, error) {
+	var chat TChat
+	req := struct {
+		ChatID string `json:"chat_id"`
+	}{chatID}
+	tresp, err := t.callJSON("getChat", req)
+	if err != nil {
+		t.log.Error("getChat failed", zap.Error(err))
+		return chat, err
+	}
+
+	if err := json.Unmarshal(tresp.Result, &chat); err != nil {
+		return chat, err
+	}
+
+	return chat, nil
+}
+
+// PinChatMessage pins a message in a chat, members are notified unless
+// disableNotification is true
+func (t *Telegram) PinChatMessage(chatID string, messageID int64, disableNotification bool) error {
+	req := struct {
+		ChatID              string `json:"chat_id"`
+		MessageID           int64  `json:"message_id"`
+		DisableNotification bool   `json:"disable_notification,omitempty"`
+	}{chatID, messageID, disableNotification}
+	if _, err := t.callJSON("pinChatMessage", req); err != nil {
+		t.log.Error("pinChatMessage failed", zap.Error(err))
+		return rightsError(err)
+	}
+
+	return nil
+}
+
+// UnpinChatMessage unpins a message in a chat
+func (t *Telegram) UnpinChatMessage(chatID string, messageID int64) error {
+	req := struct {
+		ChatID    string `json:"chat_id"`
+		MessageID int64  `json:"message_id"`
+	}{chatID, messageID}
+	if _, err := t.callJSON("unpinChatMessage", req); err != nil {
+		t.log.Error("unpinChatMessage failed", zap.Error(err))
+		return rightsError(err)
+	}
+
+	return nil
+}
+
+// UnpinAllChatMessages unpins every pinned message in a chat
+func (t *Telegram) UnpinAllChatMessages(chatID string) error {
+	req := struct {
+		ChatID string `json:"chat_id"`
+	}{chatID}
+	if _, err := t.callJSON("unpinAllChatMessages", req); err != nil {
+		t.log.Error("unpinAllChatMessages failed", zap.Error(err))
+		return rightsError(err)
+	}
+
+	return nil
+}
+
+// SendLocation sends a point on the map to a chat
+func (t *Telegram) SendLocation(chatID string, lat, lon float64) error {
+	req := struct {
+		ChatID string `json:"chat_id"`
+		TLocation
+	}{chatID, TLocation{Latitude: lat, Longitude: lon}}
+	if _, err := t.callJSON("sendLocation", req); err != nil {
+		t.log.Error("sendLocation failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// SendPoll sends a poll to a chat, answers of non anonymous poll are
+// delivered to plugins as PollAnswer
+func (t *Telegram) SendPoll(chatID, question string, options []string, anonymous bool) error {
+	req := struct {
+		ChatID      string   `json:"chat_id"`
+		Question    string   `json:"question"`
+		Options     []string `json:"options"`
+		IsAnonymous bool     `json:"is_anonymous"`
+	}{chatID, question, options, anonymous}
+	if _, err := t.callJSON("sendPoll", req); err != nil {
+		t.log.Error("sendPoll failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// SendMediaGroup sends 2 to 10 photos or videos as an album
+func (t *Telegram) SendMediaGroup(chatID string, media []InputMedia) error {
+	if len(media) < 2 || len(media) > 10 {
+		return fmt.Errorf("media group must have 2-10 items, got %d", len(media))
+	}
+
+	items := make([]TInputMedia, len(media))
+	for i, m := range media {
+		if m.Type != MediaPhoto && m.Type != MediaVideo {
+			return fmt.Errorf("invalid media type %q", m.Type)
+		}
+		items[i] = TInputMedia{
+			Type:      m.Type,
+			Media:     m.Media,
+			Caption:   m.Caption,
+			ParseMode: string(m.Format),
+		}
+	}
+
+	req := struct {
+		ChatID string        `json:"chat_id"`
+		Media  []TInputMedia `json:"media"`
+	}{chatID, items}
+	if _, err := t.callJSON("sendMediaGroup", req); err != nil {
+		t.log.Error("sendMediaGroup failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// SendDice sends an animated emoji and returns the value rolled by telegram,
+// emoji is one of 🎲 🎯 🏀 ⚽ 🎳 🎰
+func (t *Telegram) SendDice(chatID string, emoji string) (int, error) {
+	if !diceEmoji[emoji] {
+		return 0, fmt.Errorf("invalid dice emoji %q", emoji)
+	}
+
+	req := struct {
+		ChatID string `json:"chat_id"`
+		Emoji  string `json:"emoji"`
+	}{chatID, emoji}
+	tresp, err := t.callJSON("sendDice", req)
+	if err != nil {
+		t.log.Error("sendDice failed", zap.Error(err))
+		return 0, err
+	}
+
+	var m TMessage
+	if err := json.Unmarshal(tresp.Result, &m); err != nil {
+		return 0, err
+	}
+	if m.Dice == nil {
+		return 0, errors.New("sendDice response has no dice")
+	}
+
+	return m.Dice.Value, nil
+}
+
+// SendContact sends a phone contact, lastName may be empty
+func (t *Telegram) SendContact(chatID, phone, firstName string, lastName string) error {
+	req := struct {
+		ChatID string `json:"chat_id"`
+		TContact
+	}{chatID, TContact{PhoneNumber: phone, FirstName: firstName, LastName: lastName}}
+	if _, err := t.callJSON("sendContact", req); err != nil {
+		t.log.Error("sendContact failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// Leave leaves a group or channel.
+//
+// Deprecated: use Telegram.LeaveChat.
+func (t *Telegram) Leave(chanID string) error {
+	return t.LeaveChat(chanID)
+}
+
+// LeaveChat makes the bot leave a group, supergroup or channel
+func (t *Telegram) LeaveChat(chatID string) error {
+	req := struct {
+		ChatID string `json:"chat_id"`
+	}{chatID}
+	if _, err := t.callJSON("leaveChat", req); err != nil {
+		t.log.Error("leaveChat failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// GetChatMemberCount returns the number of members in a chat
+func (t *Telegram) GetChatMemberCount(chatID string) (int, error) {
+	req := struct {
+		ChatID string `json:"chat_id"`
+	}{chatID}
+	tresp, err := t.callJSON("getChatMemberCount", req)
+	if err != nil {
+		t.log.Error("getChatMemberCount failed", zap.Error(err))
+		return 0, err
+	}
+
+	var count int
+	if err := json.Unmarshal(tresp.Result, &count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// maxChatTitle is the longest chat title or description in characters
+const maxChatTitle = 255
+
+// SetChatTitle changes the title of a group or channel, title must be 1-255
+// characters. The bot must be an administrator with the rights to do so.
+func (t *Telegram) SetChatTitle(chatID, title string) error {
+	if n := utf8.RuneCountInString(title); n == 0 || n > maxChatTitle {
+		return fmt.Errorf("invalid chat title length %d, must be 1-%d characters", n, maxChatTitle)
+	}
+	req := struct {
+		ChatID string `json:"chat_id"`
+		Title  string `json:"title"`
+	}{chatID, title}
+	if _, err := t.callJSON("setChatTitle", req); err != nil {
+		t.log.Error("setChatTitle failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// SetChatDescription changes the description of a group or channel, desc
+// must be at most 255 characters and an empty desc removes it
+func (t *Telegram) SetChatDescription(chatID, desc string) error {
+	if n := utf8.RuneCountInString(desc); n > maxChatTitle {
+		return fmt.Errorf("invalid chat description length %d, must be at most %d characters", n, maxChatTitle)
+	}
+	req := struct {
+		ChatID      string `json:"chat_id"`
+		Description string `json:"description"`
+	}{chatID, desc}
+	if _, err := t.callJSON("setChatDescription", req); err != nil {
+		t.log.Error("setChatDescription failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// maxInviteMembers is the largest member limit of an invite link
+const maxInviteMembers = 99999
+
+// CreateChatInviteLink creates an additional invite link of a chat and
+// returns it. The bot must be an administrator with the rights to invite.
+func (t *Telegram) CreateChatInviteLink(chatID string, opts InviteLinkOptions) (string, error) {
+	if opts.MemberLimit < 0 || opts.MemberLimit > maxInviteMembers {
+		return "", fmt.Errorf("invalid member limit %d, must be at most %d", opts.MemberLimit, maxInviteMembers)
+	}
+	if opts.MemberLimit > 0 && opts.CreatesJoinRequest {
+		return "", fmt.Errorf("member limit can't be used with join requests")
+	}
+	req := struct {
+		ChatID             string `json:"chat_id"`
+		ExpireDate         int64  `json:"expire_date,omitempty"`
+		MemberLimit        int    `json:"member_limit,omitempty"`
+		CreatesJoinRequest bool   `json:"creates_join_request,omitempty"`
+	}{ChatID: chatID, MemberLimit: opts.MemberLimit, CreatesJoinRequest: opts.CreatesJoinRequest}
+	if !opts.ExpireDate.IsZero() {
+		req.ExpireDate = opts.ExpireDate.Unix()
+	}
+	tresp, err := t.callJSON("createChatInviteLink", req)
+	if err != nil {
+		t.log.Error("createChatInviteLink failed", zap.Error(err))
+		return "", err
+	}
+
+	var link TChatInviteLink
+	if err := json.Unmarshal(tresp.Result, &link); err != nil {
+		return "", err
+	}
+
+	return link.InviteLink, nil
+}
+
+// RevokeChatInviteLink revokes an invite link created by the bot, users can
+// no longer join with it
+func (t *Telegram) RevokeChatInviteLink(chatID, link string) error {
+	req := struct {
+		ChatID     string `json:"chat_id"`
+		InviteLink string `json:"invite_link"`
+	}{chatID, link}
+	if _, err := t.callJSON("revokeChatInviteLink", req); err != nil {
+		t.log.Error("revokeChatInviteLink failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// Member returns the raw membership of user in a chat.
+//
+// Deprecated: use GetChatMember.
+func (t *Telegram) Member(chanID, userID string) (*TChatMember, error) {
+	// userID is passed through as is like it always was
+	req := struct {
+		ChatID string `json:"chat_id"`
+		UserID string `json:"user_id"`
+	}{chanID, userID}
+	member, err := t.chatMember(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &member, nil
+}
+
+// GetChatMember returns membership of user in a chat
+func (t *Telegram) GetChatMember(chatID, userID string) (ChatMember, error) {
+	uid, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return ChatMember{}, fmt.Errorf("invalid user id %q: %s", userID, err)
+	}
+	req := struct {
+		ChatID string `json:"chat_id"`
+		UserID int64  `json:"user_id"`
+	}{chatID, uid}
+	member, err := t.chatMember(req)
+	if err != nil {
+		return ChatMember{}, err
+	}
+
+	return ChatMember{
+		User:   newUser(member.User),
+		Status: ChatMemberStatus(member.Status),
+	}, nil
+}
+
+// chatMember calls getChatMember with req
+func (t *Telegram) chatMember(req interface{}) (TChatMember, error) {
+	var member TChatMember
+	tresp, err := t.callJSON("getChatMember", req)
+	if err != nil {
+		t.log.Error("getChatMember failed", zap.Error(err))
+		return member, err
+	}
+
+	if err := json.Unmarshal(tresp.Result, &member); err != nil {
+		return member, err
+	}
+
+	return member, nil
+}
+
+// IsAdmin reports whether user is the creator or an administrator of a chat
+func (t *Telegram) IsAdmin(chatID, userID string) (bool, error) {
+	member, err := t.GetChatMember(chatID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return member.IsAdmin(), nil
+}
+
+// BanChatMember bans user from a chat until the given time, zero until bans
+// forever. It returns ErrNotEnoughRights if the bot is not an administrator.
+func (t *Telegram) BanChatMember(chatID, userID string, until time.Time) error {
+	uid, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid user id %q: %s", userID, err)
+	}
+	req := struct {
+		ChatID    string `json:"chat_id"`
+		UserID    int64  `json:"user_id"`
+		UntilDate int64  `json:"until_date,omitempty"`
+	}{ChatID: chatID, UserID: uid}
+	if !until.IsZero() {
+		req.UntilDate = until.Unix()
+	}
+	if _, err := t.callJSON("banChatMember", req); err != nil {
+		t.log.Error("banChatMember failed", zap.Error(err))
+		return rightsError(err)
+	}
+
+	return nil
+}
+
+// UnbanChatMember lifts the ban of user so they can join the chat again
+func (t *Telegram) UnbanChatMember(chatID, userID string) error {
+	uid, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid user id %q: %s", userID, err)
+	}
+	req := struct {
+		ChatID       string `json:"chat_id"`
+		UserID       int64  `json:"user_id"`
+		OnlyIfBanned bool   `json:"only_if_banned"`
+	}{chatID, uid, true}
+	if _, err := t.callJSON("unbanChatMember", req); err != nil {
+		t.log.Error("unbanChatMember failed", zap.Error(err))
+		return rightsError(err)
+	}
+
+	return nil
+}
+
+// RestrictChatMember limits what user can do in a supergroup until the given
+// time, zero until restricts forever. Permissions left false are taken away,
+// so a zero ChatPermissions mutes the user.
+func (t *Telegram) RestrictChatMember(chatID, userID string, perms ChatPermissions, until time.Time) error {
+	uid, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid user id %q: %s", userID, err)
+	}
+	req := struct {
+		ChatID      string           `json:"chat_id"`
+		UserID      int64            `json:"user_id"`
+		Permissions TChatPermissions `json:"permissions"`
+		UntilDate   int64            `json:"until_date,omitempty"`
+	}{ChatID: chatID, UserID: uid, Permissions: newTChatPermissions(perms)}
+	if !until.IsZero() {
+		req.UntilDate = until.Unix()
+	}
+	if _, err := t.callJSON("restrictChatMember", req); err != nil {
+		t.log.Error("restrictChatMember failed", zap.Error(err))
+		return rightsError(err)
+	}
+
+	return nil
+}
+
+// PromoteChatMember gives user the administrator rights, promoting with zero
+// AdminRights demotes the user
+func (t *Telegram) PromoteChatMember(chatID, userID string, rights AdminRights) error {
+	uid, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid user id %q: %s", userID, err)
+	}
+	req := struct {
+		ChatID string `json:"chat_id"`
+		UserID int64  `json:"user_id"`
+		TChatAdministratorRights
+	}{chatID, uid, newTChatAdministratorRights(rights)}
+	if _, err := t.callJSON("promoteChatMember", req); err != nil {
+		t.log.Error("promoteChatMember failed", zap.Error(err))
+		return rightsError(err)
+	}
+
+	return nil
+}
+
+// Kick bans user from a chat forever.
+//
+// Deprecated: use BanChatMember.
+func (t *Telegram) Kick(chanID, userID string) error {
+	return t.BanChatMember(chanID, userID, time.Time{})
+}
+
+// Unban lifts the ban of user in a chat.
+//
+// Deprecated: use UnbanChatMember.
+func (t *Telegram) Unban(chanID, userID string) error {
+	return t.UnbanChatMember(chanID, userID)
+}
+
+// isNotModified reports whether telegram refused an edit because nothing changed
+func isNotModified(tresp TResponse) bool {
+	return !tresp.Ok && strings.Contains(tresp.Description, "message is not modified")
+}
+
+// retryAfter returns how long telegram asks us to wait before sending again
+func retryAfter(resp *http.Response, tresp TResponse) time.Duration {
+	if tresp.Parameters != nil && tresp.Parameters.RetryAfter > 0 {
+		return time.Duration(tresp.Parameters.RetryAfter) * time.Second
+	}
+	if delay, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && delay > 0 {
+		return time.Duration(delay) * time.Second
+	}
+	var delay int
+	if n, _ := fmt.Sscanf(tresp.Description, "Too Many Requests: retry after %d", &delay); n == 1 && delay > 0 {
+		return time.Duration(delay) * time.Second
+	}
+
+	return defaultRetryAfter
+}
+
+// callJSON posts payload as json to telegram method and parses the response
+func (t *Telegram) callJSON(method string, payload interface{}) (TResponse, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return TResponse{}, err
+	}
+
+	resp, err := t.client.Post(fmt.Sprintf("%s/%s", t.url, method), jsonContentType, bytes.NewReader(b))
+	if err != nil {
+		return TResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	return parseResponse(resp)
+}
+
+// decodeResponse decodes telegram json response. Anything else, such as an
+// HTML page of a bad gateway, is ErrTransient.
+func decodeResponse(resp *http.Response) (TResponse, error) {
+	var tresp TResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tresp); err != nil {
+		return tresp, fmt.Errorf("%w: http %d %s response is not json: %s", ErrTransient, resp.StatusCode, resp.Header.Get("Content-Type"), err)
+	}
+
+	return tresp, nil
+}
+
+func parseResponse(resp *http.Response) (TResponse, error) {
+	tresp, err := decodeResponse(resp)
+	if err != nil {
+		return tresp, err
 	}
 	if !tresp.Ok {
-		return tresp, fmt.Errorf("code:%d description:%s", tresp.ErrorCode, tresp.Description)
+		return tresp, &TelegramError{Code: tresp.ErrorCode, Description: tresp.Description}
 	}
 
 	return tresp, nil
@@ -0,0 +1,2677 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/uber-go/zap"
+	"github.com/yulrizka/bot/telegramtest"
+)
+
+// testPlugin records updates it receives
+type testPlugin struct {
+	name string
+	in   chan interface{}
+	out  chan interface{}
+}
+
+func newTestPlugin(name string) *testPlugin {
+	return &testPlugin{name: name, in: make(chan interface{}, 100)}
+}
+
+func (p *testPlugin) Name() string { return p.name }
+
+func (p *testPlugin) Init(out chan interface{}) (chan interface{}, error) {
+	p.out = out
+	return p.in, nil
+}
+
+// next returns the next update received by the plugin
+func (p *testPlugin) next(t *testing.T) interface{} {
+	t.Helper()
+	select {
+	case msg := <-p.in:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for update")
+		return nil
+	}
+}
+
+// noUpdate fails if the plugin receives an update within d
+func (p *testPlugin) noUpdate(t *testing.T, d time.Duration) {
+	t.Helper()
+	select {
+	case msg := <-p.in:
+		t.Fatalf("unexpected update %#v", msg)
+	case <-time.After(d):
+	}
+}
+
+// rewriteTransport sends every request to target
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (rt rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = rt.target.Scheme
+	r.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// newTestTelegram returns Telegram sending every request to h
+func newTestTelegram(t *testing.T, h http.HandlerFunc) *Telegram {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg.SetHTTPClient(&http.Client{Timeout: 5 * time.Second, Transport: rewriteTransport{target}})
+	return tg
+}
+
+// newFakeTelegram returns Telegram talking to a telegramtest server
+func newFakeTelegram(t *testing.T) (*Telegram, *telegramtest.Server) {
+	t.Helper()
+	srv := telegramtest.NewServer()
+	t.Cleanup(srv.Close)
+
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg.SetHTTPClient(srv.Client())
+	return tg, srv
+}
+
+// startTestBot runs tg in background and stops it when the test ends
+func startTestBot(t *testing.T, tg *Telegram) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		tg.Start()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tg.Stop(ctx); err != nil {
+			t.Errorf("stop: %v", err)
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			t.Error("Start did not return after Stop")
+		}
+	})
+}
+
+// updatesResponse is a getUpdates response with updates as result
+func updatesResponse(updates ...string) *http.Response {
+	body := `{"ok":true,"result":[` + strings.Join(updates, ",") + `]}`
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}
+}
+
+// okHandler answers getMe and responds to each method with result from
+// results, methods without result get true
+func okHandler(results map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		w.Header().Set("Content-Type", "application/json")
+		if result, ok := results[method]; ok {
+			w.Write([]byte(`{"ok":true,"result":` + result + `}`))
+			return
+		}
+		switch method {
+		case "getMe":
+			w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"bot","username":"testbot"}}`))
+		case "getUpdates":
+			w.Write([]byte(`{"ok":true,"result":[]}`))
+		default:
+			w.Write([]byte(`{"ok":true,"result":true}`))
+		}
+	}
+}
+
+// failHandler answers method with a telegram error and everything else like
+// okHandler
+func failHandler(method string, code int, description string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/"+method) {
+			okHandler(nil)(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error_code": code, "description": description})
+	}
+}
+
+// apiRecorder answers like okHandler and records the json body of every
+// request other than getMe and getUpdates
+type apiRecorder struct {
+	results map[string]string
+
+	mu     sync.Mutex
+	calls  []string
+	bodies map[string]map[string]interface{}
+}
+
+func newAPIRecorder(results map[string]string) *apiRecorder {
+	return &apiRecorder{results: results, bodies: make(map[string]map[string]interface{})}
+}
+
+func (a *apiRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	if method != "getMe" && method != "getUpdates" {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		a.mu.Lock()
+		a.calls = append(a.calls, method)
+		a.bodies[method] = body
+		a.mu.Unlock()
+	}
+	okHandler(a.results)(w, r)
+}
+
+// body returns the last json body sent to method
+func (a *apiRecorder) body(t *testing.T, method string) map[string]interface{} {
+	t.Helper()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	body, ok := a.bodies[method]
+	if !ok {
+		t.Fatalf("%s was not called, calls: %v", method, a.calls)
+	}
+	return body
+}
+
+func TestChannelMigrated(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	update := `{"update_id":1,"message":{"message_id":1,"chat":{"id":-123,"type":"group","title":"group"},"date":1600000000,"migrate_to_chat_id":-1001234}}`
+	if _, err := tg.parseInbox(updatesResponse(update)); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, ok := p.next(t).(*ChannelMigratedMessage)
+	if !ok {
+		t.Fatal("want *ChannelMigratedMessage")
+	}
+	if migrated.FromID != "-123" || migrated.ToID != "-1001234" {
+		t.Errorf("migrated from %s to %s, want -123 to -1001234", migrated.FromID, migrated.ToID)
+	}
+	p.noUpdate(t, 50*time.Millisecond)
+}
+
+func TestOutboxContentType(t *testing.T) {
+	contentType := make(chan string, 1)
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/sendMessage") {
+			contentType <- r.Header.Get("Content-Type")
+		}
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
+	})
+	tg.poolOutbox()
+	defer tg.Stop(context.Background())
+
+	tg.output <- Message{Chat: Chat{ID: "1"}, Text: "hi"}
+	select {
+	case got := <-contentType:
+		if got != "application/json; charset=utf-8" {
+			t.Errorf("Content-Type = %q, want application/json; charset=utf-8", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not sent")
+	}
+}
+
+// startPolling polls for updates in background until the test ends
+func startPolling(t *testing.T, tg *Telegram) {
+	t.Helper()
+	go tg.poolInbox(context.Background())
+	t.Cleanup(func() { tg.Stop(context.Background()) })
+}
+
+func TestPollTimeout(t *testing.T) {
+	timeouts := make(chan string, 10)
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case timeouts <- r.URL.Query().Get("timeout"):
+		default:
+		}
+		w.Write([]byte(`{"ok":true,"result":[]}`))
+	})
+	tg.SetPollTimeout(30 * time.Second)
+	startPolling(t, tg)
+
+	select {
+	case got := <-timeouts:
+		if got != "30" {
+			t.Errorf("timeout = %q, want 30", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("getUpdates was not called")
+	}
+}
+
+func TestPollTimeoutFailureSleeps(t *testing.T) {
+	for _, unreachable := range []bool{false, true} {
+		unreachable := unreachable
+		var mu sync.Mutex
+		polls := 0
+		tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			polls++
+			mu.Unlock()
+			if unreachable {
+				// drop the connection so the request fails
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request"}`))
+		})
+		tg.SetPollTimeout(30 * time.Second)
+		startPolling(t, tg)
+
+		time.Sleep(500 * time.Millisecond)
+		mu.Lock()
+		n := polls
+		mu.Unlock()
+		if n > 5 {
+			t.Errorf("unreachable %v: %d polls in 500ms, want failed polls to sleep", unreachable, n)
+		}
+	}
+}
+
+func TestStopDrainsOutbox(t *testing.T) {
+	var mu sync.Mutex
+	sent := 0
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/sendMessage") {
+			mu.Lock()
+			sent++
+			mu.Unlock()
+			w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":[]}`))
+	})
+	tg.poolOutbox()
+
+	for i := 0; i < 5; i++ {
+		tg.output <- Message{Chat: Chat{ID: strconv.Itoa(i + 1)}, Text: "bye"}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tg.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	n := sent
+	mu.Unlock()
+	if n != 5 {
+		t.Fatalf("sent %d messages before Stop returned, want 5", n)
+	}
+	// safe to call again
+	if err := tg.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tg.Stop(ctx); err != nil {
+		t.Fatalf("Stop before Start: %v", err)
+	}
+}
+
+func TestStartTwice(t *testing.T) {
+	var mu sync.Mutex
+	polls := 0
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/getUpdates") {
+			okHandler(nil)(w, r)
+			return
+		}
+		mu.Lock()
+		polls++
+		first := polls == 1
+		mu.Unlock()
+		if first {
+			w.Write([]byte(`{"ok":true,"result":[{"update_id":1,"message":{"message_id":1,"chat":{"id":1,"type":"private"},"text":"once"}}]}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":[]}`))
+	})
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	// one of them returns right away, the other polls until Stop
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- tg.Start() }()
+	}
+	select {
+	case err := <-errs:
+		if err != ErrAlreadyStarted {
+			t.Fatalf("second Start returned %v, want ErrAlreadyStarted", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second Start did not return")
+	}
+	t.Cleanup(func() {
+		tg.Stop(context.Background())
+		if err := <-errs; err != nil {
+			t.Errorf("Start returned %v after Stop", err)
+		}
+	})
+
+	if m, ok := p.next(t).(*Message); !ok || m.Text != "once" {
+		t.Fatalf("got %#v, want the update", m)
+	}
+	p.noUpdate(t, 200*time.Millisecond)
+}
+
+func TestHTTPClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+	})
+	if tg.client.Timeout != 5*time.Second {
+		t.Fatalf("client timeout = %s, SetHTTPClient was not used", tg.client.Timeout)
+	}
+	tg.client.Timeout = 100 * time.Millisecond
+
+	started := time.Now()
+	if err := tg.Leave("1"); err == nil {
+		t.Fatal("Leave succeeded, want timeout")
+	}
+	if d := time.Since(started); d > 2*time.Second {
+		t.Errorf("Leave took %s, want it to time out after 100ms", d)
+	}
+
+	def, _ := NewTelegram("123:token")
+	if def.client.Timeout != httpTimeout {
+		t.Errorf("default client timeout = %s, want %s", def.client.Timeout, httpTimeout)
+	}
+}
+
+func TestSendPhotoFromOutbox(t *testing.T) {
+	type request struct {
+		path string
+		body map[string]interface{}
+	}
+	sent := make(chan request, 1)
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/sendPhoto") {
+			okHandler(nil)(w, r)
+			return
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		sent <- request{r.URL.Path, body}
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
+	})
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+	startTestBot(t, tg)
+
+	p.out <- PhotoMessage{Chat: Chat{ID: "1"}, Photo: "https://example.com/cat.jpg", Caption: "<b>cat</b>", Format: HTML}
+	var got request
+	select {
+	case got = <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("photo was not sent")
+	}
+	if !strings.HasSuffix(got.path, "/sendPhoto") {
+		t.Fatalf("path = %s, want sendPhoto", got.path)
+	}
+	want := map[string]string{"chat_id": "1", "photo": "https://example.com/cat.jpg", "caption": "<b>cat</b>", "parse_mode": string(HTML)}
+	for k, v := range want {
+		if got.body[k] != v {
+			t.Errorf("%s = %v, want %q", k, got.body[k], v)
+		}
+	}
+}
+
+func TestPhotoMessage(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	update := `{"update_id":10,"message":{"message_id":3,"from":{"id":7,"is_bot":false,"first_name":"Ann"},"chat":{"id":7,"first_name":"Ann","type":"private"},"date":1600000000,"photo":[` +
+		`{"file_id":"small","file_unique_id":"s","file_size":1200,"width":90,"height":67},` +
+		`{"file_id":"large","file_unique_id":"l","file_size":52000,"width":800,"height":600},` +
+		`{"file_id":"medium","file_unique_id":"m","file_size":14000,"width":320,"height":240}]}}`
+	if _, err := tg.parseInbox(updatesResponse(update)); err != nil {
+		t.Fatal(err)
+	}
+
+	m, ok := p.next(t).(*Message)
+	if !ok {
+		t.Fatal("want *Message")
+	}
+	if len(m.Photo) != 3 || m.Text != "" {
+		t.Fatalf("got %d photos and text %q, want 3 photos", len(m.Photo), m.Text)
+	}
+	largest, ok := m.LargestPhoto()
+	if !ok || largest != (Photo{FileID: "large", Width: 800, Height: 600, FileSize: 52000}) {
+		t.Errorf("LargestPhoto() = %+v, %v", largest, ok)
+	}
+}
+
+func TestGetFileDownload(t *testing.T) {
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/file/bot123:token/photos/file_1.jpg" {
+			w.Write([]byte("jpeg bytes"))
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/file/") {
+			http.NotFound(w, r)
+			return
+		}
+		okHandler(map[string]string{
+			"getFile": `{"file_id":"abc","file_unique_id":"u","file_size":10,"file_path":"photos/file_1.jpg"}`,
+		})(w, r)
+	})
+
+	file, err := tg.GetFile("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.FilePath != "photos/file_1.jpg" {
+		t.Fatalf("file path = %q", file.FilePath)
+	}
+	var b strings.Builder
+	if err := tg.DownloadFile(file.FilePath, &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "jpeg bytes" {
+		t.Errorf("downloaded %q, want jpeg bytes", b.String())
+	}
+	if err := tg.DownloadFile("missing", &b); err == nil {
+		t.Error("downloading a missing file succeeded")
+	}
+}
+
+func TestInlineKeyboardMarkup(t *testing.T) {
+	out, _ := newTOutMessage(Message{
+		Chat: Chat{ID: "1"},
+		Text: "pick",
+		InlineKeyboard: InlineKeyboard{{
+			{Text: "Yes", CallbackData: "yes"},
+			{Text: "Docs", URL: "https://example.com"},
+		}},
+	})
+	b, _ := json.Marshal(out)
+	want := `"reply_markup":{"inline_keyboard":[[{"text":"Yes","callback_data":"yes"},{"text":"Docs","url":"https://example.com"}]]}`
+	if !strings.Contains(string(b), want) {
+		t.Errorf("got %s, want it to contain %s", b, want)
+	}
+
+	out, _ = newTOutMessage(Message{Chat: Chat{ID: "1"}, Text: "plain"})
+	b, _ = json.Marshal(out)
+	if strings.Contains(string(b), "reply_markup") {
+		t.Errorf("plain message has reply_markup: %s", b)
+	}
+}
+
+func TestCallbackQuery(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	update := `{"update_id":1,"callback_query":{"id":"q1","from":{"id":7,"first_name":"Ann"},"chat_instance":"ci","data":"vote:yes",` +
+		`"message":{"message_id":9,"chat":{"id":7,"type":"private"},"date":1600000000}}}`
+	if _, err := tg.parseInbox(updatesResponse(update)); err != nil {
+		t.Fatal(err)
+	}
+
+	q, ok := p.next(t).(*CallbackQuery)
+	if !ok {
+		t.Fatal("want *CallbackQuery")
+	}
+	if q.ID != "q1" || q.Data != "vote:yes" || q.From.ID != "7" {
+		t.Errorf("unexpected callback %+v", q)
+	}
+	if q.Message == nil || q.Message.ID != "9" {
+		t.Errorf("callback message = %+v, want message 9", q.Message)
+	}
+}
+
+func TestAnswerCallbackQuery(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	if err := tg.AnswerCallbackQuery("q1", "", false); err != nil {
+		t.Fatal(err)
+	}
+	body := api.body(t, "answerCallbackQuery")
+	if body["callback_query_id"] != "q1" {
+		t.Errorf("callback_query_id = %v, want q1", body["callback_query_id"])
+	}
+	if _, ok := body["text"]; ok {
+		t.Error("dismissing sent text")
+	}
+
+	if err := tg.AnswerCallbackQuery("q2", "saved", true); err != nil {
+		t.Fatal(err)
+	}
+	body = api.body(t, "answerCallbackQuery")
+	if body["text"] != "saved" || body["show_alert"] != true {
+		t.Errorf("body = %v, want text saved shown as alert", body)
+	}
+}
+
+func TestEditMessageText(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	if err := tg.EditMessageText("1", 5, "*done*", Markdown); err != nil {
+		t.Fatal(err)
+	}
+	body := api.body(t, "editMessageText")
+	if body["chat_id"] != "1" || body["message_id"] != float64(5) || body["text"] != "*done*" || body["parse_mode"] != string(Markdown) {
+		t.Errorf("body = %v", body)
+	}
+
+	if err := tg.EditInlineMessageText("inline1", "done", Text); err != nil {
+		t.Fatal(err)
+	}
+	body = api.body(t, "editMessageText")
+	if body["inline_message_id"] != "inline1" {
+		t.Errorf("body = %v, want inline_message_id", body)
+	}
+	if _, ok := body["chat_id"]; ok {
+		t.Errorf("inline edit sent chat_id: %v", body)
+	}
+}
+
+func TestEditMessageTextNotModified(t *testing.T) {
+	tg := newTestTelegram(t, failHandler("editMessageText", 400,
+		"Bad Request: message is not modified: specified new message content and reply markup are exactly the same as a current content and reply markup of the message"))
+
+	if err := tg.EditMessageText("1", 5, "same", Text); !errors.Is(err, ErrMessageNotModified) {
+		t.Errorf("err = %v, want ErrMessageNotModified", err)
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+	if err := tg.DeleteMessage("1", 5); err != nil {
+		t.Fatal(err)
+	}
+	if body := api.body(t, "deleteMessage"); body["chat_id"] != "1" || body["message_id"] != float64(5) {
+		t.Errorf("body = %v", body)
+	}
+
+	tg = newTestTelegram(t, failHandler("deleteMessage", 400, "Bad Request: message can't be deleted"))
+	if err := tg.DeleteMessage("1", 5); !errors.Is(err, ErrMessageCantBeDeleted) {
+		t.Errorf("err = %v, want ErrMessageCantBeDeleted", err)
+	}
+}
+
+func TestDispatchUpdate(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	raw := `{"message_id":42,"from":{"id":7,"first_name":"Ann","last_name":"Lee","username":"ann"},"chat":{"id":-100,"type":"supergroup","title":"gophers"},"date":1600000000,"text":"hi"}`
+	receivedAt := time.Now()
+	tg.dispatchUpdate(TUpdate{UpdateID: 1, Message: json.RawMessage(raw)}, receivedAt)
+
+	m, ok := p.next(t).(*Message)
+	if !ok {
+		t.Fatal("want *Message")
+	}
+	if m.ID != "42" || m.Text != "hi" || !m.Date.Equal(time.Unix(1600000000, 0)) || !m.ReceivedAt.Equal(receivedAt) {
+		t.Errorf("unexpected message %+v", m)
+	}
+	if m.From.ID != "7" || m.From.FullName() != "Ann Lee" || m.From.Username != "ann" {
+		t.Errorf("From = %+v", m.From)
+	}
+	if m.Chat.ID != "-100" || m.Chat.Type != SuperGroup || m.Chat.Title != "gophers" {
+		t.Errorf("Chat = %+v", m.Chat)
+	}
+	if string(m.Raw) != raw {
+		t.Errorf("Raw = %s", m.Raw)
+	}
+	p.noUpdate(t, 10*time.Millisecond)
+}
+
+func TestParseInboxMalformedUpdate(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	tg.SetMetricsRegistry(metrics.NewRegistry())
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	resp := updatesResponse(
+		`{"update_id":5,"message":{"message_id":1,"chat":{"id":1,"type":"private"},"text":"first"}}`,
+		`{"update_id":"6","message":{"message_id":2}}`,
+		`{"update_id":7,"message":{"message_id":3,"chat":{"id":1,"type":"private"},"text":"last"}}`,
+	)
+	if _, err := tg.parseInbox(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"first", "last"} {
+		if m, ok := p.next(t).(*Message); !ok || m.Text != want {
+			t.Fatalf("got %#v, want %s", m, want)
+		}
+	}
+	p.noUpdate(t, 10*time.Millisecond)
+	if got := atomic.LoadInt64(&tg.lastUpdate); got != 7 {
+		t.Errorf("lastUpdate = %d, want 7", got)
+	}
+	if n := tg.stats.updateMalformedCount.Count(); n != 1 {
+		t.Errorf("telegram.updates.malformed = %d, want 1", n)
+	}
+
+	// a malformed last update doesn't move the offset back
+	if _, err := tg.parseInbox(updatesResponse(`{"update_id":"8"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt64(&tg.lastUpdate); got != 7 {
+		t.Errorf("lastUpdate = %d after a malformed update, want 7", got)
+	}
+}
+
+func TestInputPolicyBlock(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	slow := &testPlugin{name: "slow", in: make(chan interface{})}
+	tg.AddPlugin(slow)
+	tg.SetInputPolicy(Block, 0)
+
+	const n = 20
+	received := make(chan string, n)
+	go func() {
+		for i := 0; i < n; i++ {
+			m := (<-slow.in).(*Message)
+			received <- m.ID
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for i := 1; i <= n; i++ {
+		raw := fmt.Sprintf(`{"message_id":%d,"chat":{"id":1,"type":"private"},"text":"hi"}`, i)
+		tg.dispatchUpdate(TUpdate{UpdateID: int64(i), Message: []byte(raw)}, time.Now())
+	}
+	for i := 1; i <= n; i++ {
+		if got := <-received; got != strconv.Itoa(i) {
+			t.Fatalf("received message %s, want %d", got, i)
+		}
+	}
+}
+
+func TestInputPolicyBlockStop(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	stuck := &testPlugin{name: "stuck", in: make(chan interface{})}
+	tg.AddPlugin(stuck)
+	tg.SetInputPolicy(Block, 0)
+
+	done := make(chan struct{})
+	go func() {
+		tg.dispatchUpdate(TUpdate{UpdateID: 1, Message: []byte(`{"message_id":1,"chat":{"id":1,"type":"private"},"text":"hi"}`)}, time.Now())
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	tg.Stop(ctx)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("delivery to a stuck plugin did not stop")
+	}
+}
+
+func TestSendChatAction(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	if err := tg.SendChatAction("1", UploadPhoto); err != nil {
+		t.Fatal(err)
+	}
+	if body := api.body(t, "sendChatAction"); body["chat_id"] != "1" || body["action"] != "upload_photo" {
+		t.Errorf("body = %v", body)
+	}
+
+	stop := tg.KeepChatAction("2", Typing)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		api.mu.Lock()
+		chatID := api.bodies["sendChatAction"]["chat_id"]
+		api.mu.Unlock()
+		if chatID == "2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("KeepChatAction did not send the action")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	stop()
+	stop()
+	if body := api.body(t, "sendChatAction"); body["action"] != "typing" {
+		t.Errorf("action = %v, want typing", body["action"])
+	}
+}
+
+func TestReplyToMessageID(t *testing.T) {
+	out, _ := newTOutMessage(Message{Chat: Chat{ID: "1"}, Text: "reply", ReplyMessageID: "77"})
+	b, _ := json.Marshal(out)
+	if !strings.Contains(string(b), `"reply_to_message_id":77`) {
+		t.Errorf("reply has no reply_to_message_id: %s", b)
+	}
+
+	out, _ = newTOutMessage(Message{Chat: Chat{ID: "1"}, Text: "plain"})
+	b, _ = json.Marshal(out)
+	if strings.Contains(string(b), "reply_to_message_id") {
+		t.Errorf("plain message has reply_to_message_id: %s", b)
+	}
+}
+
+func TestReplyToMessage(t *testing.T) {
+	raw := `{"message_id":2,"from":{"id":7,"first_name":"Ann"},"chat":{"id":7,"type":"private"},"date":1600000100,"text":"thanks",` +
+		`"reply_to_message":{"message_id":1,"from":{"id":1,"is_bot":true,"first_name":"bot"},"chat":{"id":7,"type":"private"},"date":1600000000,"text":"here you go"}}`
+	var m TMessage
+	if err := json.Unmarshal([]byte(raw), &m); err != nil {
+		t.Fatal(err)
+	}
+	message := newMessage(m, json.RawMessage(raw), time.Now())
+	reply := message.ReplyTo
+	if reply == nil {
+		t.Fatal("ReplyTo is nil")
+	}
+	if reply.ID != "1" || reply.Text != "here you go" || reply.From.ID != "1" {
+		t.Errorf("ReplyTo = %+v", reply)
+	}
+	if reply.ReplyTo != nil {
+		t.Error("ReplyTo is nested more than one level")
+	}
+}
+
+func TestGetMe(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		okHandler(nil)(w, r)
+	})
+
+	for i := 0; i < 2; i++ {
+		me, err := tg.GetMe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if me.Username != "testbot" {
+			t.Errorf("GetMe() = %+v", me)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("getMe called %d times, want the result cached", calls)
+	}
+}
+
+func TestStartInvalidToken(t *testing.T) {
+	tg := newTestTelegram(t, failHandler("getMe", 401, "Unauthorized"))
+
+	done := make(chan error, 1)
+	go func() { done <- tg.Start() }()
+	select {
+	case err := <-done:
+		var terr *TelegramError
+		if !errors.As(err, &terr) || terr.Code != 401 {
+			t.Errorf("Start() = %v, want 401", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not fail with an invalid token")
+	}
+}
+
+func TestSplitLongMessage(t *testing.T) {
+	var mu sync.Mutex
+	var sent []map[string]interface{}
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		sent = append(sent, body)
+		mu.Unlock()
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
+	})
+	tg.SetOutboxRateLimit(0, 0)
+	tg.poolOutbox()
+
+	words := strings.Repeat("lorem ipsum ", 834) // 10008 characters
+	tg.output <- Message{Chat: Chat{ID: "1"}, Text: words, Format: HTML}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tg.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 3 {
+		t.Fatalf("sent %d messages, want 3", len(sent))
+	}
+	var joined string
+	for i, s := range sent {
+		text, _ := s["text"].(string)
+		if n := len([]rune(text)); n > maxMessageLength {
+			t.Errorf("part %d has %d characters", i, n)
+		}
+		if i < 2 && !strings.HasSuffix(text, " ") {
+			t.Errorf("part %d is not cut at a space", i)
+		}
+		if s["parse_mode"] != string(HTML) {
+			t.Errorf("part %d parse_mode = %v, want HTML", i, s["parse_mode"])
+		}
+		joined += text
+	}
+	if joined != words {
+		t.Error("parts don't add up to the original text in order")
+	}
+}
+
+func TestSplitTextUTF16(t *testing.T) {
+	// every emoji is 2 UTF-16 code units, 3000 of them is 6000 units
+	text := strings.Repeat("😀", 3000)
+	chunks := splitText(text, maxMessageLength)
+	if len(chunks) != 2 {
+		t.Fatalf("got %d chunks, want 2", len(chunks))
+	}
+	for i, c := range chunks {
+		units := 0
+		for _, r := range c {
+			units += utf16Len(r)
+		}
+		if units > maxMessageLength {
+			t.Errorf("chunk %d has %d UTF-16 code units", i, units)
+		}
+	}
+	if chunks[0]+chunks[1] != text {
+		t.Error("chunks don't add up to the text")
+	}
+	if got := splitText("short", maxMessageLength); len(got) != 1 || got[0] != "short" {
+		t.Errorf("splitText(short) = %q", got)
+	}
+}
+
+func TestForwardAndCopyMessage(t *testing.T) {
+	api := newAPIRecorder(map[string]string{"copyMessage": `{"message_id":9}`})
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	if err := tg.ForwardMessage("2", "1", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := tg.CopyMessage("3", "1", 6); err != nil {
+		t.Fatal(err)
+	}
+	for method, want := range map[string][]interface{}{
+		"forwardMessage": {"2", "1", float64(5)},
+		"copyMessage":    {"3", "1", float64(6)},
+	} {
+		body := api.body(t, method)
+		if body["chat_id"] != want[0] || body["from_chat_id"] != want[1] || body["message_id"] != want[2] {
+			t.Errorf("%s body = %v, want %v", method, body, want)
+		}
+	}
+
+	tg = newTestTelegram(t, failHandler("forwardMessage", 400, "Bad Request: message to forward not found"))
+	var terr *TelegramError
+	if err := tg.ForwardMessage("2", "1", 5); !errors.As(err, &terr) || terr.Code != 400 {
+		t.Errorf("err = %v, want TelegramError 400", err)
+	}
+}
+
+func TestConcurrentAddPlugin(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 50; i++ {
+			update := fmt.Sprintf(`{"update_id":%d,"message":{"message_id":%d,"chat":{"id":1,"type":"private"},"text":"hi"}}`, i, i)
+			if _, err := tg.parseInbox(updatesResponse(update)); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			if err := tg.AddPlugin(newTestPlugin(fmt.Sprintf("p%d", i))); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+	if atomic.LoadInt64(&tg.lastUpdate) == 0 {
+		t.Error("no update was processed")
+	}
+}
+
+func TestAddPluginAfterStart(t *testing.T) {
+	updates := make(chan string, 3)
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/getUpdates") {
+			okHandler(nil)(w, r)
+			return
+		}
+		select {
+		case u := <-updates:
+			w.Write([]byte(`{"ok":true,"result":[` + u + `]}`))
+		case <-time.After(10 * time.Millisecond):
+			w.Write([]byte(`{"ok":true,"result":[]}`))
+		}
+	})
+	tg.SetPollTimeout(time.Second)
+	update := func(id int, text string) string {
+		return fmt.Sprintf(`{"update_id":%d,"message":{"message_id":%d,"chat":{"id":1,"type":"private"},"text":%q}}`, id, id, text)
+	}
+	first := newTestPlugin("first")
+	tg.AddPlugin(first)
+	startTestBot(t, tg)
+
+	updates <- update(1, "before")
+	first.next(t)
+
+	late := newTestPlugin("late")
+	if err := tg.AddPlugin(late); err != nil {
+		t.Fatal(err)
+	}
+	updates <- update(2, "after")
+	if m := late.next(t).(*Message); m.Text != "after" {
+		t.Errorf("late plugin got %q, want only updates after it was added", m.Text)
+	}
+	first.next(t)
+
+	tg.RemovePlugin(late)
+	updates <- update(3, "removed")
+	first.next(t)
+	if _, open := <-late.in; open {
+		t.Error("input of removed plugin is still open")
+	}
+}
+
+func TestInputPolicyBlockRemovePlugin(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	stuck := &testPlugin{name: "stuck", in: make(chan interface{})}
+	tg.AddPlugin(stuck)
+	tg.SetInputPolicy(Block, 0)
+
+	done := make(chan struct{})
+	go func() {
+		tg.dispatchUpdate(TUpdate{UpdateID: 1, Message: []byte(`{"message_id":1,"chat":{"id":1,"type":"private"},"text":"hi"}`)}, time.Now())
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	removed := make(chan struct{})
+	go func() {
+		tg.RemovePlugin(stuck)
+		close(removed)
+	}()
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Fatal("RemovePlugin of a stuck plugin did not return")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("delivery to the removed plugin did not stop")
+	}
+	if _, open := <-stuck.in; open {
+		t.Error("input channel of the removed plugin is not closed")
+	}
+}
+
+func TestStartContextCancel(t *testing.T) {
+	polling := make(chan struct{}, 1)
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/getUpdates") {
+			select {
+			case polling <- struct{}{}:
+			default:
+			}
+			// hold the long poll until the client gives up
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		okHandler(nil)(w, r)
+	})
+	tg.SetPollTimeout(30 * time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- tg.StartContext(ctx) }()
+	<-polling
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("StartContext() = %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("StartContext did not return after cancel")
+	}
+	select {
+	case <-tg.outboxDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("outbox did not stop after cancel")
+	}
+}
+
+func TestAllowedUpdates(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	if strings.Contains(tg.updatesURL(), "allowed_updates") {
+		t.Errorf("allowed_updates sent by default: %s", tg.updatesURL())
+	}
+
+	tg.SetAllowedUpdates("message", "callback_query")
+	u, err := url.Parse(tg.updatesURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(u.RawQuery, "allowed_updates=%5B%22message%22%2C%22callback_query%22%5D") {
+		t.Errorf("query %s is not url encoded json", u.RawQuery)
+	}
+	if got := u.Query().Get("allowed_updates"); got != `["message","callback_query"]` {
+		t.Errorf("allowed_updates = %s", got)
+	}
+
+	tg.SetAllowedUpdates()
+	if strings.Contains(tg.updatesURL(), "allowed_updates") {
+		t.Errorf("allowed_updates sent after reset: %s", tg.updatesURL())
+	}
+}
+
+func TestEditedMessage(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	update := `{"update_id":1,"edited_message":{"message_id":4,"from":{"id":7,"first_name":"Ann"},"chat":{"id":7,"type":"private"},"date":1600000000,"edit_date":1600000060,"text":"fixed typo"}}`
+	if _, err := tg.parseInbox(updatesResponse(update)); err != nil {
+		t.Fatal(err)
+	}
+
+	edited, ok := p.next(t).(*EditedMessage)
+	if !ok {
+		t.Fatal("want *EditedMessage")
+	}
+	if edited.ID != "4" || edited.Text != "fixed typo" || !edited.EditDate.Equal(time.Unix(1600000060, 0)) {
+		t.Errorf("unexpected edit %+v", edited)
+	}
+}
+
+func TestChannelPost(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	channel := `{"id":-1001,"type":"channel","title":"news"}`
+	resp := updatesResponse(
+		`{"update_id":1,"channel_post":{"message_id":1,"chat":`+channel+`,"date":1600000000,"text":"posted"}}`,
+		`{"update_id":2,"edited_channel_post":{"message_id":1,"chat":`+channel+`,"date":1600000000,"edit_date":1600000100,"text":"edited"}}`,
+	)
+	if _, err := tg.parseInbox(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	post, ok := p.next(t).(*Message)
+	if !ok {
+		t.Fatal("want *Message")
+	}
+	if post.Chat.Type != Channel || post.Text != "posted" || post.From.ID != "" {
+		t.Errorf("unexpected channel post %+v", post)
+	}
+	edited, ok := p.next(t).(*EditedMessage)
+	if !ok || edited.Chat.Type != Channel || edited.Text != "edited" {
+		t.Errorf("unexpected edited channel post %+v", edited)
+	}
+}
+
+func TestSetMyCommands(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	cmds := []BotCommand{{Command: "start", Description: "start the bot"}, {Command: "get_stats2", Description: "stats"}}
+	if err := tg.SetMyCommands(cmds); err != nil {
+		t.Fatal(err)
+	}
+	sent, _ := json.Marshal(api.body(t, "setMyCommands")["commands"])
+	if string(sent) != `[{"command":"start","description":"start the bot"},{"command":"get_stats2","description":"stats"}]` {
+		t.Errorf("commands = %s", sent)
+	}
+
+	for _, name := range []string{"Start", "", "with-dash", "/start", strings.Repeat("a", 33)} {
+		if err := tg.SetMyCommands([]BotCommand{{Command: name, Description: "x"}}); err == nil {
+			t.Errorf("command %q was accepted", name)
+		}
+	}
+}
+
+func TestSendToUsername(t *testing.T) {
+	api := newAPIRecorder(map[string]string{"sendMessage": `{"message_id":1,"chat":{"id":-1001}}`})
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	ref := ChatByUsername("mychannel")
+	if ref != "@mychannel" || !ref.IsUsername() || ChatByID(-1001).IsUsername() {
+		t.Fatalf("ChatRef %q", ref)
+	}
+	tg.poolOutbox()
+	tg.output <- Message{Chat: Chat{ID: string(ref)}, Text: "news"}
+	if err := tg.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.body(t, "sendMessage")["chat_id"]; got != "@mychannel" {
+		t.Errorf("chat_id = %v, want @mychannel", got)
+	}
+}
+
+func TestGetChat(t *testing.T) {
+	api := newAPIRecorder(map[string]string{"getChat": `{"id":-100,"type":"supergroup","title":"Gophers","description":"all about go","invite_link":"https://t.me/+abc","permissions":{"can_send_messages":true},"pinned_message":{"message_id":7,"text":"rules"}}`})
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	chat, err := tg.GetChat("-100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := api.body(t, "getChat")["chat_id"]; got != "-100" {
+		t.Errorf("chat_id = %v", got)
+	}
+	if chat.Title != "Gophers" || chat.Description != "all about go" || chat.InviteLink != "https://t.me/+abc" {
+		t.Errorf("chat = %+v", chat)
+	}
+	if chat.Permissions == nil || !chat.Permissions.CanSendMessages {
+		t.Errorf("permissions = %+v", chat.Permissions)
+	}
+	if chat.PinnedMessage == nil || chat.PinnedMessage.Text != "rules" {
+		t.Errorf("pinned message = %+v", chat.PinnedMessage)
+	}
+}
+
+func TestGetChatMember(t *testing.T) {
+	tests := []struct {
+		name   string
+		result string
+		status ChatMemberStatus
+		admin  bool
+	}{
+		{"admin", `{"user":{"id":42,"first_name":"ann"},"status":"administrator"}`, Administrator, true},
+		{"creator", `{"user":{"id":42,"first_name":"ann"},"status":"creator"}`, Creator, true},
+		{"non member", `{"user":{"id":42,"first_name":"ann"},"status":"left"}`, Left, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newAPIRecorder(map[string]string{"getChatMember": tt.result})
+			tg := newTestTelegram(t, api.ServeHTTP)
+
+			member, err := tg.GetChatMember("-100", "42")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := api.body(t, "getChatMember")
+			if body["chat_id"] != "-100" || body["user_id"] != float64(42) {
+				t.Errorf("body = %v", body)
+			}
+			if member.Status != tt.status || member.User.ID != "42" {
+				t.Errorf("member = %+v", member)
+			}
+
+			admin, err := tg.IsAdmin("-100", "42")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if admin != tt.admin {
+				t.Errorf("IsAdmin = %t, want %t", admin, tt.admin)
+			}
+		})
+	}
+}
+
+func TestMemberPassesUserID(t *testing.T) {
+	api := newAPIRecorder(map[string]string{"getChatMember": `{"user":{"id":42,"first_name":"ann"},"status":"member"}`})
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	// unlike GetChatMember it never rejected a user id itself
+	member, err := tg.Member("-100", "@ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := api.body(t, "getChatMember"); body["user_id"] != "@ann" {
+		t.Errorf("user_id = %v, want it passed through", body["user_id"])
+	}
+	if member.Status != "member" {
+		t.Errorf("member = %+v", member)
+	}
+	if _, err := tg.GetChatMember("-100", "@ann"); err == nil {
+		t.Error("GetChatMember accepted a non numeric user id")
+	}
+}
+
+func TestBanChatMember(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	until := time.Unix(1700000000, 0)
+	if err := tg.BanChatMember("-100", "42", until); err != nil {
+		t.Fatal(err)
+	}
+	body := api.body(t, "banChatMember")
+	if body["chat_id"] != "-100" || body["user_id"] != float64(42) || body["until_date"] != float64(1700000000) {
+		t.Errorf("body = %v", body)
+	}
+
+	if err := tg.BanChatMember("-100", "42", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.body(t, "banChatMember")["until_date"]; ok {
+		t.Error("until_date sent for a permanent ban")
+	}
+
+	if err := tg.UnbanChatMember("-100", "42"); err != nil {
+		t.Fatal(err)
+	}
+	body = api.body(t, "unbanChatMember")
+	if body["chat_id"] != "-100" || body["user_id"] != float64(42) || body["only_if_banned"] != true {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestBanChatMemberNotEnoughRights(t *testing.T) {
+	tg := newTestTelegram(t, failHandler("banChatMember", http.StatusBadRequest, "Bad Request: not enough rights to restrict/unrestrict chat member"))
+	if err := tg.BanChatMember("-100", "42", time.Time{}); err != ErrNotEnoughRights {
+		t.Errorf("err = %v, want ErrNotEnoughRights", err)
+	}
+
+	tg = newTestTelegram(t, failHandler("unbanChatMember", http.StatusBadRequest, "Bad Request: CHAT_ADMIN_REQUIRED"))
+	if err := tg.Unban("-100", "42"); err != ErrNotEnoughRights {
+		t.Errorf("err = %v, want ErrNotEnoughRights", err)
+	}
+}
+
+func TestPinChatMessage(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	if err := tg.PinChatMessage("-100", 7, true); err != nil {
+		t.Fatal(err)
+	}
+	body := api.body(t, "pinChatMessage")
+	if body["chat_id"] != "-100" || body["message_id"] != float64(7) || body["disable_notification"] != true {
+		t.Errorf("pin body = %v", body)
+	}
+
+	if err := tg.UnpinChatMessage("-100", 7); err != nil {
+		t.Fatal(err)
+	}
+	body = api.body(t, "unpinChatMessage")
+	if body["chat_id"] != "-100" || body["message_id"] != float64(7) {
+		t.Errorf("unpin body = %v", body)
+	}
+
+	if err := tg.UnpinAllChatMessages("-100"); err != nil {
+		t.Fatal(err)
+	}
+	if body = api.body(t, "unpinAllChatMessages"); body["chat_id"] != "-100" || len(body) != 1 {
+		t.Errorf("unpin all body = %v", body)
+	}
+}
+
+func TestReplyKeyboard(t *testing.T) {
+	kb := &ReplyKeyboard{Rows: [][]string{{"yes", "no"}, {"maybe"}}, OneTime: true, Resize: true}
+	out, err := newTOutMessage(Message{Chat: Chat{ID: "-100"}, Text: "pick one", ReplyKeyboard: kb})
+	if err != nil {
+		t.Fatal(err)
+	}
+	markup, _ := json.Marshal(out.ReplyMarkup)
+	if string(markup) != `{"keyboard":[[{"text":"yes"},{"text":"no"}],[{"text":"maybe"}]],"one_time_keyboard":true,"resize_keyboard":true}` {
+		t.Errorf("reply_markup = %s", markup)
+	}
+
+	out, err = newTOutMessage(Message{Chat: Chat{ID: "-100"}, Text: "thanks", RemoveKeyboard: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	markup, _ = json.Marshal(out.ReplyMarkup)
+	if string(markup) != `{"remove_keyboard":true}` {
+		t.Errorf("reply_markup = %s", markup)
+	}
+
+	tg, _ := NewTelegram("123:token")
+	if _, err := tg.newOutgoing(Message{Chat: Chat{ID: "-100"}, Text: "both", ReplyKeyboard: kb, RemoveKeyboard: true}); err == nil {
+		t.Error("message with two keyboards was accepted")
+	}
+}
+
+func TestSendLocation(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	if err := tg.SendLocation("-100", 52.37, 4.89); err != nil {
+		t.Fatal(err)
+	}
+	body := api.body(t, "sendLocation")
+	if body["chat_id"] != "-100" || body["latitude"] != 52.37 || body["longitude"] != 4.89 {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestInboundLocation(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	resp := updatesResponse(`{"update_id":1,"message":{"message_id":1,"from":{"id":42,"first_name":"ann"},"chat":{"id":42,"type":"private"},"date":1600000000,"location":{"latitude":52.37,"longitude":4.89}}}`)
+	if _, err := tg.parseInbox(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, ok := p.next(t).(*Message)
+	if !ok {
+		t.Fatal("want *Message")
+	}
+	if msg.Location == nil || *msg.Location != (Location{Latitude: 52.37, Longitude: 4.89}) {
+		t.Errorf("location = %+v", msg.Location)
+	}
+}
+
+func TestSendPoll(t *testing.T) {
+	api := newAPIRecorder(map[string]string{"sendPoll": `{"message_id":3,"chat":{"id":-100}}`})
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	if err := tg.SendPoll("-100", "lunch?", []string{"pizza", "sushi"}, false); err != nil {
+		t.Fatal(err)
+	}
+	body := api.body(t, "sendPoll")
+	options, _ := json.Marshal(body["options"])
+	if body["chat_id"] != "-100" || body["question"] != "lunch?" || string(options) != `["pizza","sushi"]` || body["is_anonymous"] != false {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestPollAnswer(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	resp := updatesResponse(`{"update_id":1,"poll_answer":{"poll_id":"poll-1","user":{"id":42,"first_name":"ann"},"option_ids":[0,2]}}`)
+	if _, err := tg.parseInbox(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	answer, ok := p.next(t).(*PollAnswer)
+	if !ok {
+		t.Fatal("want *PollAnswer")
+	}
+	if answer.PollID != "poll-1" || answer.User.ID != "42" || len(answer.OptionIDs) != 2 || answer.OptionIDs[1] != 2 {
+		t.Errorf("answer = %+v", answer)
+	}
+}
+
+func TestNewTelegramKey(t *testing.T) {
+	for _, key := range []string{"", "token", "123:", ":token", "123:to ken"} {
+		if tg, err := NewTelegram(key); err == nil || tg != nil {
+			t.Errorf("NewTelegram(%q) = %v, %v, want error", key, tg, err)
+		}
+	}
+
+	if tg := MustNewTelegram("123:AA-token_x"); tg == nil {
+		t.Error("MustNewTelegram returned nil")
+	}
+}
+
+// recordingLogger records messages logged at error level
+type recordingLogger struct {
+	zap.Logger
+	mu     *sync.Mutex
+	errors *[]string
+}
+
+func newRecordingLogger() recordingLogger {
+	return recordingLogger{Logger: zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard))), mu: new(sync.Mutex), errors: new([]string)}
+}
+
+func (l recordingLogger) With(...zap.Field) zap.Logger { return l }
+
+func (l recordingLogger) Error(msg string, _ ...zap.Field) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	*l.errors = append(*l.errors, msg)
+}
+
+func (l recordingLogger) logged() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), *l.errors...)
+}
+
+func TestInstanceLogger(t *testing.T) {
+	failing := newTestTelegram(t, failHandler("getChat", http.StatusBadRequest, "Bad Request: chat not found"))
+	healthy := newTestTelegram(t, okHandler(map[string]string{"getChat": `{"id":-100,"type":"group"}`}))
+	failingLog, healthyLog := newRecordingLogger(), newRecordingLogger()
+	failing.SetLogger(failingLog)
+	healthy.SetLogger(healthyLog)
+
+	if _, err := failing.GetChat("-100"); err == nil {
+		t.Fatal("want error")
+	}
+	if _, err := healthy.GetChat("-100"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := failingLog.logged(); len(got) != 1 || got[0] != "getChat failed" {
+		t.Errorf("failing instance logged %q", got)
+	}
+	if got := healthyLog.logged(); len(got) != 0 {
+		t.Errorf("healthy instance logged %q", got)
+	}
+}
+
+func TestSendMediaGroup(t *testing.T) {
+	api := newAPIRecorder(map[string]string{"sendMediaGroup": `[{"message_id":1},{"message_id":2},{"message_id":3}]`})
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	media := []InputMedia{
+		{Type: MediaPhoto, Media: "https://example.com/a.jpg", Caption: "*album*", Format: Markdown},
+		{Type: MediaPhoto, Media: "file-id-b"},
+		{Type: MediaPhoto, Media: "file-id-c"},
+	}
+	if err := tg.SendMediaGroup("-100", media); err != nil {
+		t.Fatal(err)
+	}
+	body := api.body(t, "sendMediaGroup")
+	sent, _ := json.Marshal(body["media"])
+	want := `[{"caption":"*album*","media":"https://example.com/a.jpg","parse_mode":"Markdown","type":"photo"},{"media":"file-id-b","type":"photo"},{"media":"file-id-c","type":"photo"}]`
+	if body["chat_id"] != "-100" || string(sent) != want {
+		t.Errorf("body = %v, media %s", body, sent)
+	}
+
+	invalid := [][]InputMedia{
+		media[:1],
+		make([]InputMedia, 11),
+		{{Type: MediaPhoto, Media: "a"}, {Type: "audio", Media: "b"}},
+	}
+	for _, m := range invalid {
+		if err := tg.SendMediaGroup("-100", m); err == nil {
+			t.Errorf("media group of %d items %v was accepted", len(m), m)
+		}
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.calls) != 1 {
+		t.Errorf("calls = %v, want only the valid media group", api.calls)
+	}
+}
+
+func albumUpdate(id int64, groupID string) TUpdate {
+	raw := fmt.Sprintf(`{"message_id":%d,"media_group_id":%q,"chat":{"id":5,"type":"private"},"photo":[{"file_id":"p%d","width":1,"height":1}]}`, id, groupID, id)
+	return TUpdate{UpdateID: id, Message: []byte(raw)}
+}
+
+func TestAlbum(t *testing.T) {
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg.SetAlbumWindow(50 * time.Millisecond)
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	for id := int64(1); id <= 3; id++ {
+		tg.dispatchUpdate(albumUpdate(id, "g1"), time.Now())
+	}
+
+	album, ok := p.next(t).(*AlbumMessage)
+	if !ok {
+		t.Fatal("want *AlbumMessage")
+	}
+	if album.MediaGroupID != "g1" || len(album.Messages) != 3 || album.Messages[2].ID != "3" {
+		t.Errorf("album = %+v", album)
+	}
+	p.noUpdate(t, 100*time.Millisecond)
+}
+
+func TestStopFlushesAlbums(t *testing.T) {
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg.SetAlbumWindow(time.Hour)
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	tg.dispatchUpdate(albumUpdate(1, "g1"), time.Now())
+	tg.dispatchUpdate(albumUpdate(2, "g1"), time.Now())
+	p.noUpdate(t, 20*time.Millisecond)
+
+	if err := tg.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	album, ok := p.next(t).(*AlbumMessage)
+	if !ok || len(album.Messages) != 2 {
+		t.Fatalf("want album of 2 on Stop, got %+v", album)
+	}
+
+	tg.albumMu.Lock()
+	pending := len(tg.albums)
+	tg.albumMu.Unlock()
+	if pending != 0 {
+		t.Errorf("%d albums still buffered after Stop", pending)
+	}
+
+	// items arriving while stopping are not held back
+	tg.dispatchUpdate(albumUpdate(3, "g2"), time.Now())
+	if msg, ok := p.next(t).(*Message); !ok || msg.MediaGroupID != "g2" {
+		t.Errorf("want the late album item as *Message, got %+v", msg)
+	}
+}
+
+func TestSendDice(t *testing.T) {
+	api := newAPIRecorder(map[string]string{"sendDice": `{"message_id":9,"chat":{"id":-100},"dice":{"emoji":"🎯","value":5}}`})
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	value, err := tg.SendDice("-100", "🎯")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 5 {
+		t.Errorf("value = %d, want 5", value)
+	}
+	if body := api.body(t, "sendDice"); body["chat_id"] != "-100" || body["emoji"] != "🎯" {
+		t.Errorf("body = %v", body)
+	}
+
+	if _, err := tg.SendDice("-100", "🍕"); err == nil {
+		t.Error("invalid emoji was accepted")
+	}
+}
+
+func TestOutboxResult(t *testing.T) {
+	tg := newTestTelegram(t, okHandler(map[string]string{"sendMessage": `{"message_id":77,"chat":{"id":1}}`}))
+	tg.poolOutbox()
+	t.Cleanup(func() { tg.Stop(context.Background()) })
+
+	result := make(chan SendResult, 1)
+	tg.output <- Message{Chat: Chat{ID: "1"}, Text: "hi", Result: result}
+	select {
+	case r := <-result:
+		if r.Err != nil || r.MessageID != 77 {
+			t.Errorf("result = %+v, want message id 77", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for send result")
+	}
+}
+
+func TestSendMessageSync(t *testing.T) {
+	api := newAPIRecorder(map[string]string{"sendMessage": `{"message_id":12,"chat":{"id":1}}`})
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	id, err := tg.SendMessage(Message{Chat: Chat{ID: "1"}, Text: "*hi*", Format: Markdown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 12 {
+		t.Errorf("id = %d, want 12", id)
+	}
+	if body := api.body(t, "sendMessage"); body["chat_id"] != "1" || body["text"] != "*hi*" || body["parse_mode"] != "Markdown" {
+		t.Errorf("body = %v", body)
+	}
+	if len(tg.output) != 0 {
+		t.Error("SendMessage queued the message to the outbox")
+	}
+
+	tg = newTestTelegram(t, failHandler("sendMessage", http.StatusBadRequest, "Bad Request: message text is empty"))
+	id, err = tg.SendMessage(Message{Chat: Chat{ID: "1"}, Text: "hi"})
+	if err == nil || id != 0 {
+		t.Errorf("got %d, %v, want error", id, err)
+	}
+}
+
+func TestStartConflict(t *testing.T) {
+	tg := newTestTelegram(t, failHandler("getUpdates", http.StatusConflict, "Conflict: terminated by other getUpdates request; make sure that only one bot instance is running"))
+
+	done := make(chan error, 1)
+	go func() { done <- tg.Start() }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrConflict) {
+			t.Errorf("Start = %v, want ErrConflict", err)
+		}
+	case <-time.After(5 * time.Second):
+		tg.Stop(context.Background())
+		t.Fatal("Start kept polling after a conflict")
+	}
+}
+
+func TestRestrictChatMember(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	// mute for an hour
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := tg.RestrictChatMember("-100", "42", ChatPermissions{}, until); err != nil {
+		t.Fatal(err)
+	}
+	body := api.body(t, "restrictChatMember")
+	perms, _ := json.Marshal(body["permissions"])
+	want := `{"can_add_web_page_previews":false,"can_change_info":false,"can_invite_users":false,"can_pin_messages":false,"can_send_media_messages":false,"can_send_messages":false,"can_send_other_messages":false,"can_send_polls":false}`
+	if string(perms) != want {
+		t.Errorf("permissions = %s", perms)
+	}
+	if body["chat_id"] != "-100" || body["user_id"] != float64(42) || body["until_date"] != float64(until.Unix()) {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestPromoteChatMember(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	if err := tg.PromoteChatMember("-100", "42", AdminRights{CanDeleteMessages: true, CanPinMessages: true}); err != nil {
+		t.Fatal(err)
+	}
+	body := api.body(t, "promoteChatMember")
+	if body["user_id"] != float64(42) || body["can_delete_messages"] != true || body["can_pin_messages"] != true || body["can_promote_members"] != false {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestChatMemberEvents(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	group := `{"id":-100,"type":"group","title":"gophers"}`
+	resp := updatesResponse(
+		`{"update_id":1,"message":{"message_id":1,"chat":`+group+`,"date":1600000000,"from":{"id":1,"first_name":"admin"},"new_chat_members":[{"id":2,"first_name":"ann"},{"id":3,"first_name":"bob"}]}}`,
+		`{"update_id":2,"message":{"message_id":2,"chat":`+group+`,"date":1600000001,"from":{"id":3,"first_name":"bob"},"left_chat_member":{"id":3,"first_name":"bob"}}}`,
+	)
+	if _, err := tg.parseInbox(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	joined, ok := p.next(t).(*ChatMemberJoinedMessage)
+	if !ok {
+		t.Fatal("want *ChatMemberJoinedMessage")
+	}
+	if len(joined.Members) != 2 || joined.Members[0].ID != "2" || joined.Members[1].FirstName != "bob" || joined.Chat.ID != "-100" {
+		t.Errorf("joined = %+v", joined)
+	}
+	left, ok := p.next(t).(*ChatMemberLeftMessage)
+	if !ok {
+		t.Fatal("want *ChatMemberLeftMessage")
+	}
+	if left.Member.ID != "3" || left.Chat.ID != "-100" {
+		t.Errorf("left = %+v", left)
+	}
+}
+
+func TestInboundVideo(t *testing.T) {
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	video := `{"file_id":"vid","width":640,"height":360,"duration":12,"mime_type":"video/mp4","file_size":1024}`
+	tg.dispatchUpdate(TUpdate{UpdateID: 1, Message: []byte(`{"message_id":1,"chat":{"id":5,"type":"private"},"video":` + video + `}`)}, time.Now())
+	tg.dispatchUpdate(TUpdate{UpdateID: 2, Message: []byte(`{"message_id":2,"chat":{"id":5,"type":"private"},"animation":{"file_id":"gif","duration":2}}`)}, time.Now())
+
+	msg := p.next(t).(*Message)
+	want := Video{FileID: "vid", Width: 640, Height: 360, Duration: 12 * time.Second, MimeType: "video/mp4", FileSize: 1024}
+	if msg.Video == nil || *msg.Video != want {
+		t.Errorf("video = %+v, want %+v", msg.Video, want)
+	}
+	msg = p.next(t).(*Message)
+	if msg.Animation == nil || msg.Animation.FileID != "gif" || msg.Animation.Duration != 2*time.Second || msg.Video != nil {
+		t.Errorf("animation = %+v, video = %+v", msg.Animation, msg.Video)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	var stalled int32
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/getUpdates") && atomic.LoadInt32(&stalled) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		okHandler(nil)(w, r)
+	})
+	tg.SetPollInterval(10*time.Millisecond, 0)
+
+	if tg.Healthy(time.Hour) || !tg.LastSuccessfulPoll().IsZero() {
+		t.Error("healthy before the first poll")
+	}
+	startTestBot(t, tg)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !tg.Healthy(time.Second) {
+		if time.Now().After(deadline) {
+			t.Fatal("not healthy after polling")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	atomic.StoreInt32(&stalled, 1)
+	last := tg.LastSuccessfulPoll()
+	time.Sleep(200 * time.Millisecond)
+	if tg.Healthy(100 * time.Millisecond) {
+		t.Errorf("healthy while polls fail, last success %s ago", time.Since(last))
+	}
+	if !tg.Healthy(time.Hour) {
+		t.Error("not healthy within a large max age")
+	}
+}
+
+func TestPollDelayJitter(t *testing.T) {
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tg.pollInterval != time.Second || tg.pollJitter != 0.2 {
+		t.Errorf("default interval %s jitter %g, want 1s 0.2", tg.pollInterval, tg.pollJitter)
+	}
+
+	tg.SetPollInterval(time.Second, 0.2)
+	min, max := time.Hour, time.Duration(0)
+	for i := 0; i < 10000; i++ {
+		d := tg.pollDelay()
+		if d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("pollDelay = %s, want within 0.8s-1.2s", d)
+		}
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	if max-min < 200*time.Millisecond {
+		t.Errorf("delays between %s and %s are barely randomized", min, max)
+	}
+
+	tg.SetPollInterval(time.Second, 5)
+	if tg.pollJitter != 1 {
+		t.Errorf("jitter = %g, want clamped to 1", tg.pollJitter)
+	}
+	for _, d := range []time.Duration{0, -time.Second, time.Microsecond} {
+		tg.SetPollInterval(d, 0)
+		if got := tg.pollDelay(); got != minPollInterval {
+			t.Errorf("SetPollInterval(%s) sleeps %s, want %s", d, got, minPollInterval)
+		}
+	}
+}
+
+func TestSendMessageFlags(t *testing.T) {
+	api := newAPIRecorder(map[string]string{"sendMessage": `{"message_id":1,"chat":{"id":1}}`})
+	tg := newTestTelegram(t, api.ServeHTTP)
+	tg.SetOutboxRateLimit(0, 0)
+
+	if _, err := tg.SendMessage(Message{Chat: Chat{ID: "1"}, Text: "https://example.com", DisableWebPagePreview: true, DisableNotification: true}); err != nil {
+		t.Fatal(err)
+	}
+	body := api.body(t, "sendMessage")
+	if body["disable_web_page_preview"] != true || body["disable_notification"] != true {
+		t.Errorf("body = %v, want both flags", body)
+	}
+
+	if _, err := tg.SendMessage(Message{Chat: Chat{ID: "1"}, Text: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	body = api.body(t, "sendMessage")
+	for _, key := range []string{"disable_web_page_preview", "disable_notification"} {
+		if _, ok := body[key]; ok {
+			t.Errorf("%s sent when false", key)
+		}
+	}
+}
+
+func TestEditMessageReplyMarkup(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	menu := InlineKeyboard{{{Text: "next", CallbackData: "page:2"}}}
+	if err := tg.EditMessageReplyMarkup("-100", 7, menu); err != nil {
+		t.Fatal(err)
+	}
+	body := api.body(t, "editMessageReplyMarkup")
+	markup, _ := json.Marshal(body["reply_markup"])
+	if body["chat_id"] != "-100" || body["message_id"] != float64(7) || string(markup) != `{"inline_keyboard":[[{"callback_data":"page:2","text":"next"}]]}` {
+		t.Errorf("body = %v, reply_markup %s", body, markup)
+	}
+
+	if err := tg.EditMessageReplyMarkup("-100", 7, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.body(t, "editMessageReplyMarkup")["reply_markup"]; ok {
+		t.Error("reply_markup sent when removing the keyboard")
+	}
+
+	tg = newTestTelegram(t, failHandler("editMessageReplyMarkup", http.StatusBadRequest, "Bad Request: message is not modified: specified new message content and reply markup are exactly the same"))
+	if err := tg.EditMessageReplyMarkup("-100", 7, menu); err != ErrMessageNotModified {
+		t.Errorf("err = %v, want ErrMessageNotModified", err)
+	}
+}
+
+func TestInlineQuery(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	resp := updatesResponse(`{"update_id":1,"inline_query":{"id":"q1","from":{"id":42,"first_name":"ann"},"query":"gopher","offset":"10"}}`)
+	if _, err := tg.parseInbox(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	q, ok := p.next(t).(*InlineQuery)
+	if !ok {
+		t.Fatal("want *InlineQuery")
+	}
+	if q.ID != "q1" || q.From.ID != "42" || q.Query != "gopher" || q.Offset != "10" {
+		t.Errorf("inline query = %+v", q)
+	}
+}
+
+func TestAnswerInlineQuery(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	results := []InlineQueryResult{{ID: "1", Title: "Gopher", Description: "the mascot", Text: "*gopher*", Format: Markdown}}
+	if err := tg.AnswerInlineQuery("q1", results); err != nil {
+		t.Fatal(err)
+	}
+	body := api.body(t, "answerInlineQuery")
+	sent, _ := json.Marshal(body["results"])
+	want := `[{"description":"the mascot","id":"1","input_message_content":{"message_text":"*gopher*","parse_mode":"Markdown"},"title":"Gopher","type":"article"}]`
+	if body["inline_query_id"] != "q1" || string(sent) != want {
+		t.Errorf("body = %v, results %s", body, sent)
+	}
+}
+
+func TestRawUpdateSink(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	var mu sync.Mutex
+	var raws []json.RawMessage
+	tg.SetRawUpdateSink(func(raw json.RawMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		raws = append(raws, append(json.RawMessage(nil), raw...))
+	})
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+	resp := updatesResponse(
+		`{"update_id":1,"message":{"message_id":1,"chat":{"id":42,"type":"private"},"text":"first"}}`,
+		`{"update_id":2,"unknown_kind":{"x":1}}`,
+		`{"update_id":3,"message":{"message_id":2,"chat":{"id":42,"type":"private"},"text":"second"}}`,
+	)
+	if _, err := tg.parseInbox(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	p.next(t)
+	p.next(t)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(raws) != 3 {
+		t.Fatalf("sink got %d updates, want 3", len(raws))
+	}
+	for i, want := range []string{`"text":"first"`, `"unknown_kind":{"x":1}`, `"text":"second"`} {
+		if !strings.Contains(string(raws[i]), want) {
+			t.Errorf("raw update %d = %s, want %s", i, raws[i], want)
+		}
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := make(chan Message, 10)
+	tg.SetDeadLetter(dead)
+	// two plugins with no room, each update must land once
+	for _, name := range []string{"a", "b"} {
+		tg.AddPlugin(&testPlugin{name: name, in: make(chan interface{})})
+	}
+
+	tg.dispatchUpdate(TUpdate{UpdateID: 1, Message: []byte(`{"message_id":1,"chat":{"id":5,"type":"private"},"text":"lost"}`)}, time.Now())
+
+	select {
+	case m := <-dead:
+		if m.ID != "1" || m.Text != "lost" {
+			t.Errorf("dead letter = %+v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dropped update was not forwarded to the dead letter")
+	}
+	if len(dead) != 0 {
+		t.Errorf("update forwarded %d more times", len(dead))
+	}
+}
+
+func TestMessageFormat(t *testing.T) {
+	api := newAPIRecorder(map[string]string{"sendMessage": `{"message_id":1,"chat":{"id":1}}`})
+	tg := newTestTelegram(t, api.ServeHTTP)
+	tg.SetOutboxRateLimit(0, 0)
+
+	tests := []struct {
+		format MessageFormat
+		want   interface{} // nil when parse_mode is not sent
+	}{
+		{HTML, "HTML"},
+		{"html", "HTML"},
+		{"markdown", "Markdown"},
+		{"MARKDOWNV2", "MarkdownV2"},
+		{Text, nil},
+		{"garbage", nil},
+	}
+	for _, tt := range tests {
+		if _, err := tg.SendMessage(Message{Chat: Chat{ID: "1"}, Text: "hi", Format: tt.format}); err != nil {
+			t.Fatalf("format %q: %v", tt.format, err)
+		}
+		if got := api.body(t, "sendMessage")["parse_mode"]; got != tt.want {
+			t.Errorf("format %q sent parse_mode %v, want %v", tt.format, got, tt.want)
+		}
+	}
+
+	tg.SetStrictFormat(true)
+	api.mu.Lock()
+	calls := len(api.calls)
+	api.mu.Unlock()
+	if _, err := tg.SendMessage(Message{Chat: Chat{ID: "1"}, Text: "hi", Format: "garbage"}); !errors.Is(err, ErrInvalidFormat) {
+		t.Errorf("strict garbage format err = %v, want ErrInvalidFormat", err)
+	}
+	if _, err := tg.SendMessage(Message{Chat: Chat{ID: "1"}, Text: "hi", Format: "html"}); err != nil {
+		t.Errorf("strict html format: %v", err)
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.calls) != calls+1 {
+		t.Errorf("%d messages sent in strict mode, want only the valid one", len(api.calls)-calls)
+	}
+}
+
+// closingPlugin counts calls of Close
+type closingPlugin struct {
+	*testPlugin
+	closed int32
+}
+
+func (p *closingPlugin) Close() error {
+	atomic.AddInt32(&p.closed, 1)
+	return nil
+}
+
+// groupPlugin removes itself and its helper plugin when closed
+type groupPlugin struct {
+	*closingPlugin
+	tg     *Telegram
+	helper Plugin
+}
+
+func (p *groupPlugin) Close() error {
+	p.tg.RemovePlugin(p.helper)
+	p.tg.RemovePlugin(p)
+	return p.closingPlugin.Close()
+}
+
+func TestPluginCloseRemovesPlugins(t *testing.T) {
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	helper := &closingPlugin{testPlugin: newTestPlugin("helper")}
+	group := &groupPlugin{closingPlugin: &closingPlugin{testPlugin: newTestPlugin("group")}, tg: tg, helper: helper}
+	tg.AddPlugin(helper)
+	tg.AddPlugin(group)
+
+	stopped := make(chan struct{})
+	go func() {
+		tg.Stop(context.Background())
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop deadlocked on Close calling RemovePlugin")
+	}
+	if n := atomic.LoadInt32(&group.closed); n != 1 {
+		t.Errorf("group plugin closed %d times, want 1", n)
+	}
+	if n := atomic.LoadInt32(&helper.closed); n != 1 {
+		t.Errorf("helper plugin closed %d times, want 1", n)
+	}
+}
+
+func TestPluginClose(t *testing.T) {
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := &closingPlugin{testPlugin: newTestPlugin("stopped")}
+	removed := &closingPlugin{testPlugin: newTestPlugin("removed")}
+	tg.AddPlugin(stopped)
+	tg.AddPlugin(removed)
+	tg.AddPlugin(newTestPlugin("no closer"))
+
+	tg.RemovePlugin(removed)
+	if n := atomic.LoadInt32(&removed.closed); n != 1 {
+		t.Errorf("removed plugin closed %d times, want 1", n)
+	}
+	if n := atomic.LoadInt32(&stopped.closed); n != 0 {
+		t.Errorf("plugin closed %d times before Stop", n)
+	}
+
+	tg.Stop(context.Background())
+	tg.Stop(context.Background())
+	if n := atomic.LoadInt32(&stopped.closed); n != 1 {
+		t.Errorf("plugin closed %d times on Stop, want 1", n)
+	}
+	if n := atomic.LoadInt32(&removed.closed); n != 1 {
+		t.Errorf("removed plugin closed %d times, want 1", n)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	api := newAPIRecorder(map[string]string{"sendMessage": `{"message_id":1,"chat":{"id":1}}`})
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ChatID string `json:"chat_id"`
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &body)
+		if body.ChatID == "2" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		api.ServeHTTP(w, r)
+	})
+	tg.SetOutboxRateLimit(0, 0)
+
+	errs := tg.Broadcast([]string{"1", "2", "3"}, Message{Text: "news"})
+	if len(errs) != 3 {
+		t.Fatalf("got %d errors, want one per chat", len(errs))
+	}
+	if errs[0] != nil || errs[2] != nil {
+		t.Errorf("errs = %v, want chats 1 and 3 sent", errs)
+	}
+	if !errors.Is(errs[1], ErrBotBlocked) {
+		t.Errorf("chat 2 err = %v, want ErrBotBlocked", errs[1])
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.calls) != 2 || api.bodies["sendMessage"]["chat_id"] != "3" || api.bodies["sendMessage"]["text"] != "news" {
+		t.Errorf("calls %v, last body %v", api.calls, api.bodies["sendMessage"])
+	}
+}
+
+func TestLanguageCode(t *testing.T) {
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+
+	raw := `{"message_id":1,"from":{"id":42,"first_name":"hans","language_code":"de"},"chat":{"id":42,"type":"private"},"text":"hallo"}`
+	tg.dispatchUpdate(TUpdate{UpdateID: 1, Message: []byte(raw)}, time.Now())
+	tg.dispatchUpdate(TUpdate{UpdateID: 2, CallbackQuery: &TCallbackQuery{ID: "q", From: TUser{ID: 42, LanguageCode: "de"}}}, time.Now())
+
+	if msg := p.next(t).(*Message); msg.From.LanguageCode != "de" {
+		t.Errorf("message language = %q, want de", msg.From.LanguageCode)
+	}
+	if q := p.next(t).(*CallbackQuery); q.From.LanguageCode != "de" {
+		t.Errorf("callback language = %q, want de", q.From.LanguageCode)
+	}
+}
+
+func TestSendMessageWith(t *testing.T) {
+	api := newAPIRecorder(map[string]string{"sendMessage": `{"message_id":31,"chat":{"id":-100}}`})
+	tg := newTestTelegram(t, api.ServeHTTP)
+	tg.SetOutboxRateLimit(0, 0)
+
+	id, err := tg.SendMessageWith("-100", "<b>menu</b>", SendOptions{
+		Format:                HTML,
+		ReplyMessageID:        "30",
+		MessageThreadID:       4,
+		InlineKeyboard:        InlineKeyboard{{{Text: "open", URL: "https://example.com"}}},
+		DisableWebPagePreview: true,
+		DisableNotification:   true,
+		ProtectContent:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 31 {
+		t.Errorf("id = %d, want 31", id)
+	}
+	body := api.body(t, "sendMessage")
+	want := map[string]interface{}{
+		"chat_id":                  "-100",
+		"text":                     "<b>menu</b>",
+		"parse_mode":               "HTML",
+		"reply_to_message_id":      float64(30),
+		"message_thread_id":        float64(4),
+		"disable_web_page_preview": true,
+		"disable_notification":     true,
+		"protect_content":          true,
+	}
+	for k, v := range want {
+		if body[k] != v {
+			t.Errorf("%s = %v, want %v", k, body[k], v)
+		}
+	}
+	if markup, _ := json.Marshal(body["reply_markup"]); string(markup) != `{"inline_keyboard":[[{"text":"open","url":"https://example.com"}]]}` {
+		t.Errorf("reply_markup = %s", markup)
+	}
+
+	// zero options send plain text only
+	if _, err := tg.SendMessageWith("-100", "plain", SendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if body := api.body(t, "sendMessage"); len(body) != 2 {
+		t.Errorf("body = %v, want only chat_id and text", body)
+	}
+}
+
+func TestUpdateLimit(t *testing.T) {
+	var mu sync.Mutex
+	var polls []time.Time
+	var limits []string
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/getUpdates") {
+			okHandler(nil)(w, r)
+			return
+		}
+		mu.Lock()
+		polls = append(polls, time.Now())
+		limits = append(limits, r.URL.Query().Get("limit"))
+		n := len(polls)
+		mu.Unlock()
+		if n == 1 {
+			// a full batch, the next poll must not wait
+			w.Write([]byte(`{"ok":true,"result":[{"update_id":1},{"update_id":2}]}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":[]}`))
+	})
+	tg.SetUpdateLimit(2)
+	tg.SetPollInterval(time.Second, 0)
+	startTestBot(t, tg)
+
+	time.Sleep(1500 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(polls) < 3 {
+		t.Fatalf("got %d polls, want at least 3", len(polls))
+	}
+	if limits[0] != "2" {
+		t.Errorf("limit = %q, want 2", limits[0])
+	}
+	if d := polls[1].Sub(polls[0]); d > 500*time.Millisecond {
+		t.Errorf("poll after full batch waited %s", d)
+	}
+	if d := polls[2].Sub(polls[1]); d < 900*time.Millisecond {
+		t.Errorf("poll after partial batch waited only %s", d)
+	}
+}
+
+func TestProtectContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload func(protect bool) interface{}
+	}{
+		{"message", func(protect bool) interface{} {
+			out, _ := newTOutMessage(Message{Chat: Chat{ID: "1"}, Text: "hi", ProtectContent: protect})
+			return out
+		}},
+		{"photo", func(protect bool) interface{} {
+			return newTOutPhoto(PhotoMessage{Chat: Chat{ID: "1"}, Photo: "id", ProtectContent: protect})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := json.Marshal(tt.payload(true))
+			if !strings.Contains(string(b), `"protect_content":true`) {
+				t.Errorf("protected %s missing protect_content: %s", tt.name, b)
+			}
+			b, _ = json.Marshal(tt.payload(false))
+			if strings.Contains(string(b), "protect_content") {
+				t.Errorf("unprotected %s has protect_content: %s", tt.name, b)
+			}
+		})
+	}
+}
+
+func TestLeaveChat(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	if err := tg.LeaveChat("-100"); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.body(t, "leaveChat")["chat_id"]; got != "-100" {
+		t.Errorf("chat_id = %v, want -100", got)
+	}
+}
+
+func TestGetChatMemberCount(t *testing.T) {
+	api := newAPIRecorder(map[string]string{"getChatMemberCount": "42"})
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	n, err := tg.GetChatMemberCount("-100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 42 {
+		t.Errorf("count = %d, want 42", n)
+	}
+	if got := api.body(t, "getChatMemberCount")["chat_id"]; got != "-100" {
+		t.Errorf("chat_id = %v, want -100", got)
+	}
+}
+
+func TestMyChatMember(t *testing.T) {
+	tg, srv := newFakeTelegram(t)
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+	srv.AddUpdate(map[string]interface{}{
+		"my_chat_member": map[string]interface{}{
+			"chat":            map[string]interface{}{"id": -100, "type": "supergroup", "title": "group"},
+			"from":            map[string]interface{}{"id": 7, "first_name": "admin"},
+			"date":            1600000000,
+			"old_chat_member": map[string]interface{}{"user": map[string]interface{}{"id": 1}, "status": "left"},
+			"new_chat_member": map[string]interface{}{"user": map[string]interface{}{"id": 1}, "status": "member"},
+		},
+	})
+	startTestBot(t, tg)
+
+	update, ok := p.next(t).(*BotChatMemberUpdate)
+	if !ok {
+		t.Fatal("want *BotChatMemberUpdate")
+	}
+	if update.OldStatus != Left || update.NewStatus != Member {
+		t.Errorf("status %s -> %s, want left -> member", update.OldStatus, update.NewStatus)
+	}
+	if update.Chat.ID != "-100" || update.Chat.Type != SuperGroup || update.From.ID != "7" {
+		t.Errorf("unexpected update %+v", update)
+	}
+}
+
+func TestSetChatTitle(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	if err := tg.SetChatTitle("-100", "Gophers"); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.body(t, "setChatTitle")["title"]; got != "Gophers" {
+		t.Errorf("title = %v, want Gophers", got)
+	}
+
+	for _, title := range []string{"", strings.Repeat("é", 256)} {
+		if err := tg.SetChatTitle("-100", title); err == nil {
+			t.Errorf("SetChatTitle(%d characters) succeeded, want error", len([]rune(title)))
+		}
+	}
+}
+
+func TestSetChatDescription(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	desc := strings.Repeat("é", 255)
+	if err := tg.SetChatDescription("-100", desc); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.body(t, "setChatDescription")["description"]; got != desc {
+		t.Errorf("description = %v, want %v", got, desc)
+	}
+	if err := tg.SetChatDescription("-100", desc+"x"); err == nil {
+		t.Error("SetChatDescription(256 characters) succeeded, want error")
+	}
+}
+
+func TestCreateChatInviteLink(t *testing.T) {
+	api := newAPIRecorder(map[string]string{
+		"createChatInviteLink": `{"invite_link":"https://t.me/+abc","member_limit":10,"is_revoked":false}`,
+	})
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	expire := time.Unix(1700000000, 0)
+	link, err := tg.CreateChatInviteLink("-100", InviteLinkOptions{ExpireDate: expire, MemberLimit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "https://t.me/+abc" {
+		t.Errorf("link = %q, want https://t.me/+abc", link)
+	}
+	body := api.body(t, "createChatInviteLink")
+	if body["member_limit"] != float64(10) || body["expire_date"] != float64(1700000000) {
+		t.Errorf("body = %v, want member_limit 10 and expire_date 1700000000", body)
+	}
+	if _, ok := body["creates_join_request"]; ok {
+		t.Errorf("creates_join_request sent when not set")
+	}
+
+	if _, err := tg.CreateChatInviteLink("-100", InviteLinkOptions{MemberLimit: 5, CreatesJoinRequest: true}); err == nil {
+		t.Error("member limit with join request succeeded, want error")
+	}
+}
+
+func TestRevokeChatInviteLink(t *testing.T) {
+	api := newAPIRecorder(map[string]string{
+		"revokeChatInviteLink": `{"invite_link":"https://t.me/+abc","is_revoked":true}`,
+	})
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	if err := tg.RevokeChatInviteLink("-100", "https://t.me/+abc"); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.body(t, "revokeChatInviteLink")["invite_link"]; got != "https://t.me/+abc" {
+		t.Errorf("invite_link = %v, want https://t.me/+abc", got)
+	}
+}
+
+func TestForwardInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{"forward_from", `{"message_id":1,"chat":{"id":5,"type":"private"},"text":"hi","forward_from":{"id":42,"first_name":"Ann"},"forward_date":1600000000}`},
+		{"forward_origin", `{"message_id":1,"chat":{"id":5,"type":"private"},"text":"hi","forward_origin":{"type":"user","date":1600000000,"sender_user":{"id":42,"first_name":"Ann"}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m TMessage
+			if err := json.Unmarshal([]byte(tt.raw), &m); err != nil {
+				t.Fatal(err)
+			}
+			fwd := newMessage(m, nil, time.Now()).Forward
+			if fwd == nil || fwd.From == nil {
+				t.Fatalf("Forward = %+v, want original sender", fwd)
+			}
+			if fwd.From.ID != "42" || fwd.From.FirstName != "Ann" || !fwd.Date.Equal(time.Unix(1600000000, 0)) {
+				t.Errorf("Forward = %+v, From = %+v", fwd, fwd.From)
+			}
+		})
+	}
+
+	m := newMessage(TMessage{Text: "hi"}, nil, time.Now())
+	if m.Forward != nil {
+		t.Errorf("Forward = %+v for a message that wasn't forwarded", m.Forward)
+	}
+}
+
+func TestAnswerCallbackQueryWith(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	err := tg.AnswerCallbackQueryWith("q1", CallbackAnswer{URL: "https://t.me/mybot?start=game", CacheTime: 30 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := api.body(t, "answerCallbackQuery")
+	if body["callback_query_id"] != "q1" || body["url"] != "https://t.me/mybot?start=game" || body["cache_time"] != float64(30) {
+		t.Errorf("body = %v", body)
+	}
+	if _, ok := body["text"]; ok {
+		t.Errorf("empty text sent")
+	}
+}
+
+func TestPollBackoff(t *testing.T) {
+	var mu sync.Mutex
+	var polls []time.Time
+	tg := newTestTelegram(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/getUpdates") {
+			okHandler(nil)(w, r)
+			return
+		}
+		mu.Lock()
+		polls = append(polls, time.Now())
+		mu.Unlock()
+		w.Write([]byte("<html>bad gateway</html>"))
+	})
+	tg.SetPollInterval(20*time.Millisecond, 0)
+	startTestBot(t, tg)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(polls)
+		mu.Unlock()
+		if n >= 6 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(polls) < 6 {
+		t.Fatalf("got %d polls, want 6", len(polls))
+	}
+	// 5 failures wait 20ms, 40ms, 80ms, 160ms and 320ms
+	for i := 1; i < 6; i++ {
+		gap := polls[i].Sub(polls[i-1])
+		want := 20 * time.Millisecond << uint(i-1)
+		if gap < want {
+			t.Errorf("failure %d waited %s, want at least %s", i, gap, want)
+		}
+	}
+
+	if got := tg.pollBackoff(1); got != 20*time.Millisecond {
+		t.Errorf("pollBackoff(1) = %s, want 20ms", got)
+	}
+	if got := tg.pollBackoff(100); got != maxPollBackoff {
+		t.Errorf("pollBackoff(100) = %s, want %s", got, maxPollBackoff)
+	}
+}
+
+func TestMessageThreadID(t *testing.T) {
+	var m TMessage
+	raw := `{"message_id":1,"chat":{"id":-100,"type":"supergroup"},"text":"hi","message_thread_id":7}`
+	if err := json.Unmarshal([]byte(raw), &m); err != nil {
+		t.Fatal(err)
+	}
+	if got := newMessage(m, nil, time.Now()).MessageThreadID; got != 7 {
+		t.Errorf("inbound MessageThreadID = %d, want 7", got)
+	}
+
+	api := newAPIRecorder(map[string]string{"sendMessage": `{"message_id":2,"chat":{"id":-100}}`})
+	tg := newTestTelegram(t, api.ServeHTTP)
+	if _, err := tg.SendMessage(Message{Chat: Chat{ID: "-100"}, Text: "in topic", MessageThreadID: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.body(t, "sendMessage")["message_thread_id"]; got != float64(7) {
+		t.Errorf("message_thread_id = %v, want 7", got)
+	}
+
+	if _, err := tg.SendMessage(Message{Chat: Chat{ID: "-100"}, Text: "no topic"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.body(t, "sendMessage")["message_thread_id"]; ok {
+		t.Error("message_thread_id sent without a topic")
+	}
+}
+
+func TestPauseOutbox(t *testing.T) {
+	tg, srv := newFakeTelegram(t)
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+	tg.PauseOutbox()
+	startTestBot(t, tg)
+
+	srv.AddMessage(1, "still received")
+	if m, ok := p.next(t).(*Message); !ok || m.Text != "still received" {
+		t.Fatalf("got %#v while paused, want the update", m)
+	}
+
+	for _, text := range []string{"one", "two", "three"} {
+		p.out <- Message{Chat: Chat{ID: "1"}, Text: text}
+	}
+	time.Sleep(200 * time.Millisecond)
+	if sent := srv.Sent(); len(sent) != 0 {
+		t.Fatalf("sent %d requests while paused", len(sent))
+	}
+
+	tg.ResumeOutbox()
+	sent, err := srv.WaitSent(3, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"one", "two", "three"} {
+		if got := sent[i].Text("text"); got != want {
+			t.Errorf("sent[%d] = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestCaption(t *testing.T) {
+	raw := `{"message_id":1,"chat":{"id":5,"type":"private"},"photo":[{"file_id":"p1","width":90,"height":90}],"caption":"look #cat","caption_entities":[{"type":"hashtag","offset":5,"length":4}]}`
+
+	for _, fallback := range []bool{false, true} {
+		tg, _ := NewTelegram("123:token")
+		p := newTestPlugin("p")
+		tg.AddPlugin(p)
+		tg.SetCaptionAsText(fallback)
+		tg.dispatchUpdate(TUpdate{UpdateID: 1, Message: []byte(raw)}, time.Now())
+
+		m, ok := p.next(t).(*Message)
+		if !ok {
+			t.Fatal("want *Message")
+		}
+		if m.Caption != "look #cat" || len(m.CaptionEntities) != 1 || m.CaptionEntities[0].Text != "#cat" {
+			t.Errorf("caption %q entities %+v", m.Caption, m.CaptionEntities)
+		}
+		if len(m.Photo) != 1 {
+			t.Errorf("got %d photos, want 1", len(m.Photo))
+		}
+		wantText := ""
+		if fallback {
+			wantText = "look #cat"
+		}
+		if m.Text != wantText || (fallback && len(m.Entities) != 1) {
+			t.Errorf("caption as text %v: text %q entities %+v", fallback, m.Text, m.Entities)
+		}
+	}
+}
+
+func TestSendContact(t *testing.T) {
+	api := newAPIRecorder(map[string]string{"sendContact": `{"message_id":2,"chat":{"id":5}}`})
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	if err := tg.SendContact("5", "+123456", "Ann", ""); err != nil {
+		t.Fatal(err)
+	}
+	body := api.body(t, "sendContact")
+	if body["chat_id"] != "5" || body["phone_number"] != "+123456" || body["first_name"] != "Ann" {
+		t.Errorf("body = %v", body)
+	}
+	if _, ok := body["last_name"]; ok {
+		t.Error("empty last_name sent")
+	}
+}
+
+func TestContactMessage(t *testing.T) {
+	var m TMessage
+	raw := `{"message_id":1,"chat":{"id":5,"type":"private"},"contact":{"phone_number":"+123456","first_name":"Ann","last_name":"Lee","user_id":42}}`
+	if err := json.Unmarshal([]byte(raw), &m); err != nil {
+		t.Fatal(err)
+	}
+	c := newMessage(m, nil, time.Now()).Contact
+	if c == nil {
+		t.Fatal("Contact is nil")
+	}
+	if *c != (Contact{PhoneNumber: "+123456", FirstName: "Ann", LastName: "Lee", UserID: "42"}) {
+		t.Errorf("Contact = %+v", *c)
+	}
+}
+
+func TestSetBaseURL(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/file/") {
+			w.Write([]byte("content"))
+			return
+		}
+		okHandler(nil)(w, r)
+	}))
+	defer srv.Close()
+
+	tg, err := NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg.SetBaseURL(srv.URL + "/")
+	if _, err := tg.GetMe(); err != nil {
+		t.Fatal(err)
+	}
+	var file strings.Builder
+	if err := tg.DownloadFile("photos/1.jpg", &file); err != nil {
+		t.Fatal(err)
+	}
+	if file.String() != "content" {
+		t.Errorf("file = %q, want content", file.String())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"/bot123:token/getMe", "/file/bot123:token/photos/1.jpg"}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("paths = %v, want %v", paths, want)
+	}
+}
@@ -0,0 +1,324 @@
+// Package telegramtest provides a fake telegram bot API server to test bots
+// end to end without network access.
+//
+//	srv := telegramtest.NewServer()
+//	defer srv.Close()
+//
+//	telegram, _ := bot.NewTelegram("123:token")
+//	telegram.SetHTTPClient(srv.Client())
+//	telegram.AddPlugin(&myPlugin{})
+//	go telegram.Start()
+//
+//	srv.AddMessage(1, "marco")
+//	sent, err := srv.WaitSent(1, time.Second)
+package telegramtest
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BotUsername is the username returned by getMe
+const BotUsername = "testbot"
+
+// Request is a request received by the server other than getUpdates
+type Request struct {
+	// Method is telegram method such as "sendMessage"
+	Method string
+	// Body is the raw request body
+	Body []byte
+	// Params is the decoded json body or query parameters
+	Params map[string]interface{}
+}
+
+// Text returns string value of param
+func (r Request) Text(param string) string {
+	switch v := r.Params[param].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// Server is a fake telegram bot API server. Updates added to the server are
+// returned by getUpdates, every other request is recorded and answered with a
+// successful response.
+type Server struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	updates       []update
+	lastUpdateID  int64
+	lastMessageID int64
+	sent          []Request
+	sentCond      *sync.Cond
+	// added is closed and replaced when an update is added, it wakes up
+	// pending long polling getUpdates
+	added chan struct{}
+}
+
+type update struct {
+	id  int64
+	raw map[string]interface{}
+}
+
+// NewServer starts a fake telegram server, call Close when done
+func NewServer() *Server {
+	s := &Server{added: make(chan struct{})}
+	s.sentCond = sync.NewCond(&s.mu)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Client returns http client that sends requests for api.telegram.org to the
+// fake server, use it with Telegram.SetHTTPClient
+func (s *Server) Client() *http.Client {
+	target, _ := url.Parse(s.URL)
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: rewriteTransport{
+			target: target,
+			next:   http.DefaultTransport,
+		},
+	}
+}
+
+// AddUpdate queues update to be returned by getUpdates, update_id is
+// assigned by the server. update is anything marshalled to a telegram update
+// object such as {"message": {...}}.
+func (s *Server) AddUpdate(u interface{}) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastUpdateID++
+	raw["update_id"] = s.lastUpdateID
+	s.updates = append(s.updates, update{id: s.lastUpdateID, raw: raw})
+	close(s.added)
+	s.added = make(chan struct{})
+
+	return nil
+}
+
+// AddMessage queues a private text message from user userID
+func (s *Server) AddMessage(userID int64, text string) error {
+	s.mu.Lock()
+	s.lastMessageID++
+	messageID := s.lastMessageID
+	s.mu.Unlock()
+
+	user := map[string]interface{}{
+		"id":         userID,
+		"first_name": "user" + strconv.FormatInt(userID, 10),
+		"username":   "user" + strconv.FormatInt(userID, 10),
+	}
+	chat := map[string]interface{}{
+		"id":         userID,
+		"type":       "private",
+		"first_name": user["first_name"],
+		"username":   user["username"],
+	}
+	return s.AddUpdate(map[string]interface{}{
+		"message": map[string]interface{}{
+			"message_id": messageID,
+			"from":       user,
+			"chat":       chat,
+			"date":       time.Now().Unix(),
+			"text":       text,
+		},
+	})
+}
+
+// Sent returns requests received so far, except getUpdates and getMe
+func (s *Server) Sent() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.sent...)
+}
+
+// WaitSent waits until at least n requests were received
+func (s *Server) WaitSent(n int, timeout time.Duration) ([]Request, error) {
+	timer := time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		s.sentCond.Broadcast()
+		s.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	deadline := time.Now().Add(timeout)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.sent) < n {
+		if !time.Now().Before(deadline) {
+			return append([]Request(nil), s.sent...), errors.New("telegramtest: timeout waiting for sent requests")
+		}
+		s.sentCond.Wait()
+	}
+	return append([]Request(nil), s.sent...), nil
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	// path is /bot<token>/<method> or /file/bot<token>/<path>
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if parts[0] == "file" {
+		w.Write([]byte("file content"))
+		return
+	}
+	method := parts[1]
+
+	body, _ := ioutil.ReadAll(r.Body)
+	params := make(map[string]interface{})
+	for k, v := range r.URL.Query() {
+		params[k] = v[0]
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		json.Unmarshal(body, &params)
+	}
+
+	switch strings.ToLower(method) {
+	case "getupdates":
+		s.getUpdates(w, r, params)
+		return
+	case "getme":
+		writeResult(w, map[string]interface{}{
+			"id":         1,
+			"is_bot":     true,
+			"first_name": "Test Bot",
+			"username":   BotUsername,
+		})
+		return
+	}
+
+	s.mu.Lock()
+	s.sent = append(s.sent, Request{Method: method, Body: body, Params: params})
+	s.lastMessageID++
+	messageID := s.lastMessageID
+	s.sentCond.Broadcast()
+	s.mu.Unlock()
+
+	if strings.HasPrefix(strings.ToLower(method), "send") {
+		result := map[string]interface{}{
+			"message_id": messageID,
+			"date":       time.Now().Unix(),
+			"chat":       map[string]interface{}{"id": chatID(params["chat_id"])},
+			"text":       params["text"],
+		}
+		if strings.EqualFold(method, "sendDice") {
+			emoji, _ := params["emoji"].(string)
+			if emoji == "" {
+				emoji = "🎲"
+			}
+			result["dice"] = map[string]interface{}{"emoji": emoji, "value": 1 + messageID%6}
+		}
+		writeResult(w, result)
+		return
+	}
+	writeResult(w, true)
+}
+
+// getUpdates returns updates from offset, with a timeout it holds the request
+// until an update is added or the timeout passes like telegram long polling
+func (s *Server) getUpdates(w http.ResponseWriter, r *http.Request, params map[string]interface{}) {
+	offset := intParam(params["offset"])
+	timer := time.NewTimer(time.Duration(intParam(params["timeout"])) * time.Second)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		// confirmed updates are forgotten like telegram does
+		var pending []update
+		result := []map[string]interface{}{}
+		for _, u := range s.updates {
+			if u.id >= offset {
+				pending = append(pending, u)
+				result = append(result, u.raw)
+			}
+		}
+		s.updates = pending
+		added := s.added
+		s.mu.Unlock()
+
+		if len(result) > 0 {
+			writeResult(w, result)
+			return
+		}
+		select {
+		case <-added:
+		case <-timer.C:
+			writeResult(w, result)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// intParam returns numeric param sent as json number or query string
+func intParam(v interface{}) int64 {
+	switch v := v.(type) {
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// chatID returns the numeric chat_id as telegram responds with, requests may
+// send it as string
+func chatID(v interface{}) interface{} {
+	if s, ok := v.(string); ok {
+		if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return id
+		}
+	}
+	return v
+}
+
+func writeResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":     true,
+		"result": result,
+	})
+}
+
+// rewriteTransport sends every request to target
+type rewriteTransport struct {
+	target *url.URL
+	next   http.RoundTripper
+}
+
+func (t rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	r.Host = t.target.Host
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,134 @@
+package telegramtest_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/yulrizka/bot"
+	"github.com/yulrizka/bot/telegramtest"
+)
+
+// echoPlugin replies every text message with the same text
+type echoPlugin struct {
+	in  chan interface{}
+	out chan interface{}
+}
+
+func (*echoPlugin) Name() string { return "echo" }
+
+func (p *echoPlugin) Init(out chan interface{}) (chan interface{}, error) {
+	p.in = make(chan interface{}, 10)
+	p.out = out
+	go func() {
+		for msg := range p.in {
+			if m, ok := msg.(*bot.Message); ok && m.Text != "" {
+				p.out <- bot.Message{Chat: m.Chat, Text: m.Text}
+			}
+		}
+	}()
+	return p.in, nil
+}
+
+func startBot(t *testing.T, srv *telegramtest.Server) *bot.Telegram {
+	t.Helper()
+	telegram, err := bot.NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	telegram.SetHTTPClient(srv.Client())
+	telegram.SetPollTimeout(2 * time.Second)
+	telegram.SetOutboxRateLimit(0, 0)
+	if err := telegram.AddPlugin(&echoPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- telegram.Start() }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := telegram.Stop(ctx); err != nil {
+			t.Error(err)
+		}
+		<-done
+	})
+	return telegram
+}
+
+func TestEchoConversation(t *testing.T) {
+	srv := telegramtest.NewServer()
+	defer srv.Close()
+	startBot(t, srv)
+
+	conversation := []string{"marco", "polo"}
+	for i, text := range conversation {
+		if err := srv.AddMessage(42, text); err != nil {
+			t.Fatal(err)
+		}
+		sent, err := srv.WaitSent(i+1, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := sent[i]
+		if reply.Method != "sendMessage" || reply.Text("chat_id") != "42" || reply.Text("text") != text {
+			t.Errorf("reply %d is %s %s, want echo of %q", i, reply.Method, reply.Body, text)
+		}
+	}
+}
+
+func TestLongPolling(t *testing.T) {
+	srv := telegramtest.NewServer()
+	defer srv.Close()
+
+	getUpdates := func() (int, time.Duration) {
+		t.Helper()
+		start := time.Now()
+		resp, err := srv.Client().Get("https://api.telegram.org/bot123:token/getUpdates?timeout=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Result []json.RawMessage `json:"result"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return len(body.Result), time.Since(start)
+	}
+
+	// without updates the request is held until the timeout
+	if n, took := getUpdates(); n != 0 || took < time.Second {
+		t.Errorf("got %d updates after %s, want none after 1s", n, took)
+	}
+
+	// an update added while polling is returned right away
+	time.AfterFunc(100*time.Millisecond, func() { srv.AddMessage(42, "hi") })
+	if n, took := getUpdates(); n != 1 || took >= time.Second {
+		t.Errorf("got %d updates after %s, want 1 before the timeout", n, took)
+	}
+}
+
+func TestSendDice(t *testing.T) {
+	srv := telegramtest.NewServer()
+	defer srv.Close()
+
+	telegram, err := bot.NewTelegram("123:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	telegram.SetHTTPClient(srv.Client())
+
+	value, err := telegram.SendDice("42", "🎲")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value < 1 || value > 6 {
+		t.Errorf("dice value %d, want 1-6", value)
+	}
+	if sent := srv.Sent(); len(sent) != 1 || sent[0].Method != "sendDice" || sent[0].Text("emoji") != "🎲" {
+		t.Errorf("sent %v", sent)
+	}
+}
@@ -3,24 +3,265 @@ package bot
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // Message represents chat message
 type Message struct {
-	ID             string
-	From           User
-	Date           time.Time
-	Chat           Chat
-	Text           string
-	Format         MessageFormat
+	ID       string
+	From     User
+	Date     time.Time
+	Chat     Chat
+	Text     string
+	Entities []Entity
+	// Caption is the text of an incoming media message, see SetCaptionAsText.
+	Caption         string
+	CaptionEntities []Entity
+	// Command is the command of an incoming message for the bot without the
+	// slash and bot username, like "start" for "/start@mybot".
+	Command string
+	Photo   []Photo
+	Video   *Video
+	// Animation is a GIF or a video without sound.
+	Animation    *Video
+	Location     *Location
+	Contact      *Contact
+	MediaGroupID string
+	// Forward is nil unless the message was forwarded.
+	Forward *ForwardInfo
+	Format  MessageFormat
+	// ReplyMessageID is the ID of an incoming message, the message is sent as a
+	// reply threaded to it.
 	ReplyMessageID string
+	// ReplyTo is the message an incoming message is replying to.
+	ReplyTo *Message
+	// MessageThreadID is the topic of a forum supergroup the message belongs to,
+	// set it to send a message into a topic.
+	MessageThreadID       int64
+	InlineKeyboard        InlineKeyboard
+	ReplyKeyboard         *ReplyKeyboard
+	RemoveKeyboard        bool
+	DisableWebPagePreview bool
+	// DisableNotification sends the message silently.
+	DisableNotification bool
+	// ProtectContent prevents the message from being forwarded or saved.
+	ProtectContent bool
 	ReceivedAt     time.Time
 	Raw            json.RawMessage `json:"-"`
-	Retry          int             `json:"-"`
-	DiscardAfter   time.Time       `json:"-"`
+	// Retry is how many times the message is sent again after a timeout, it may
+	// then be delivered twice.
+	Retry        int       `json:"-"`
+	DiscardAfter time.Time `json:"-"`
+	// Result receives the outcome of sending the message, once for each part
+	// when the text is split.
+	Result chan<- SendResult `json:"-"`
+}
+
+// SendOptions are optional settings of a message sent with SendMessageWith,
+// the zero value sends plain text without reply or keyboard. At most one of
+// InlineKeyboard, ReplyKeyboard and RemoveKeyboard may be set.
+type SendOptions struct {
+	Format                MessageFormat
+	ReplyMessageID        string
+	MessageThreadID       int64
+	InlineKeyboard        InlineKeyboard
+	ReplyKeyboard         *ReplyKeyboard
+	RemoveKeyboard        bool
+	DisableWebPagePreview bool
+	DisableNotification   bool
+	ProtectContent        bool
+	Retry                 int
+	DiscardAfter          time.Time
+}
+
+// CallbackAnswer is the answer to a CallbackQuery. URL is opened by the
+// client, telegram only allows game URLs and t.me links to the bot. CacheTime
+// is how long the client may cache the answer, rounded down to the second.
+type CallbackAnswer struct {
+	Text      string
+	ShowAlert bool
+	URL       string
+	CacheTime time.Duration
+}
+
+// SendResult is the outcome of sending an outgoing Message, MessageID is the
+// ID telegram assigned to it. The result is skipped if the channel is full,
+// so it should be buffered.
+type SendResult struct {
+	MessageID int64
+	Err       error
+}
+
+// LargestPhoto returns the biggest available size of the photo in message
+func (m Message) LargestPhoto() (Photo, bool) {
+	var largest Photo
+	for _, p := range m.Photo {
+		if p.Width*p.Height >= largest.Width*largest.Height {
+			largest = p
+		}
+	}
+	return largest, len(m.Photo) > 0
+}
+
+// IsCommand reports whether an incoming message is a command like "/start"
+// for the bot, see ParseCommand.
+func (m Message) IsCommand() bool {
+	return m.Command != ""
+}
+
+// Entity is special part of message text such as "mention", "hashtag" or
+// "url". Offset and Length are in bytes so Text equals
+// message.Text[Offset:Offset+Length]. URL is set for "text_link".
+type Entity struct {
+	Type   string
+	Offset int
+	Length int
+	Text   string
+	URL    string
+}
+
+// Location is a point on the map shared by user
+type Location struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// Contact is a phone contact shared by user, UserID is empty unless the
+// contact is a telegram user
+type Contact struct {
+	PhoneNumber string
+	FirstName   string
+	LastName    string
+	UserID      string
+}
+
+// Photo is one size of an incoming photo
+type Photo struct {
+	FileID   string
+	Width    int
+	Height   int
+	FileSize int
+}
+
+// ForwardInfo is where a forwarded message came from. From is the original
+// sender, or nil when they hide their account and only SenderName is known.
+// FromChat is set for messages forwarded from a channel or sent on behalf of
+// a chat.
+type ForwardInfo struct {
+	From       *User
+	FromChat   *Chat
+	SenderName string
+	Date       time.Time
+}
+
+// Video is an incoming video or animation
+type Video struct {
+	FileID   string
+	Width    int
+	Height   int
+	Duration time.Duration
+	MimeType string
+	FileSize int
+}
+
+// CallbackQuery is received when user press a button of an InlineKeyboard.
+// Message is the message with the button, it is nil when the message was
+// sent in inline mode.
+type CallbackQuery struct {
+	ID              string
+	From            User
+	Data            string
+	Message         *Message
+	InlineMessageID string
+	ReceivedAt      time.Time
+}
+
+// InlineQuery is received when user types "@bot query" in any chat, answer it
+// with AnswerInlineQuery. Offset is for paginating results.
+type InlineQuery struct {
+	ID         string
+	From       User
+	Query      string
+	Offset     string
+	ReceivedAt time.Time
+}
+
+// InlineQueryResult is an article answering an InlineQuery, Text is sent to
+// the chat when the user picks it. ID must be unique among the results.
+type InlineQueryResult struct {
+	ID          string
+	Title       string
+	Description string
+	Text        string
+	Format      MessageFormat
+	URL         string
+}
+
+// BotChatMemberUpdate is received when the bot is added to, removed from or
+// promoted in a chat. From is the user who changed the status.
+type BotChatMemberUpdate struct {
+	Chat       Chat
+	From       User
+	Date       time.Time
+	OldStatus  ChatMemberStatus
+	NewStatus  ChatMemberStatus
+	ReceivedAt time.Time
+}
+
+// PollAnswer is received when user answers a non anonymous poll sent by the
+// bot, OptionIDs is empty when the vote is retracted
+type PollAnswer struct {
+	PollID     string
+	User       User
+	OptionIDs  []int
+	ReceivedAt time.Time
+}
+
+// PhotoMessage represents outgoing photo, Photo is either an URL or file_id
+// of a photo that already exists on telegram server
+type PhotoMessage struct {
+	Chat           Chat
+	Photo          string
+	Caption        string
+	Format         MessageFormat
+	ProtectContent bool
+	Retry          int       `json:"-"`
+	DiscardAfter   time.Time `json:"-"`
+}
+
+// EditedMessage is received when user edits a message, Message has the new
+// content
+type EditedMessage struct {
+	Message
+	EditDate time.Time
+}
+
+// AlbumMessage is photos or videos sent together as an album, it is only
+// received when album window is set, see SetAlbumWindow
+type AlbumMessage struct {
+	MediaGroupID string
+	Chat         Chat
+	Messages     []Message
+	ReceivedAt   time.Time
+}
+
+// InputMedia is a photo or video of an album sent with SendMediaGroup, Media
+// is either an URL or file_id
+type InputMedia struct {
+	Type    string
+	Media   string
+	Caption string
+	Format  MessageFormat
 }
 
+// Available InputMedia Type
+const (
+	MediaPhoto = "photo"
+	MediaVideo = "video"
+)
+
 type ChannelMigratedMessage struct {
 	Message
 	FromID     string
@@ -28,22 +269,76 @@ type ChannelMigratedMessage struct {
 	ReceivedAt time.Time
 }
 
+// ChatMemberJoinedMessage is received when users join or are added to a
+// group, Message.From is the user who added them
+type ChatMemberJoinedMessage struct {
+	Message
+	Members []User
+}
+
+// ChatMemberLeftMessage is received when a user leaves or is removed from a
+// group
+type ChatMemberLeftMessage struct {
+	Message
+	Member User
+}
+
+// InlineKeyboard is rows of buttons attached to an outgoing message
+type InlineKeyboard [][]InlineButton
+
+// InlineButton is a button of InlineKeyboard, either URL or CallbackData
+// should be set
+type InlineButton struct {
+	Text         string
+	URL          string
+	CallbackData string
+}
+
+// ReplyKeyboard replaces the user keyboard with buttons, pressing a button
+// sends its text. OneTime hides the keyboard after use and Resize fits its
+// height to the buttons. Set RemoveKeyboard on a later message to remove it.
+type ReplyKeyboard struct {
+	Rows    [][]string
+	OneTime bool
+	Resize  bool
+}
+
 // MessageFormat represents formatting of the message
 type MessageFormat string
 
-// Available MessageFormat
+// Available MessageFormat, the values are telegram parse_mode
 const (
-	Text     MessageFormat = ""
-	Markdown MessageFormat = "markdown"
-	HTML     MessageFormat = "html"
+	Text       MessageFormat = ""
+	Markdown   MessageFormat = "Markdown"
+	MarkdownV2 MessageFormat = "MarkdownV2"
+	HTML       MessageFormat = "HTML"
 )
 
-// User represents user information
+// markdownV2Reserved are characters that must be escaped in MarkdownV2 text
+const markdownV2Reserved = "\\_*[]()~`>#+-=|{}.!"
+
+// EscapeMarkdownV2 escapes s so it is shown as is in a MarkdownV2 message
+func EscapeMarkdownV2(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		if strings.ContainsRune(markdownV2Reserved, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// User represents user information, LanguageCode is the IETF language tag of
+// the user's client such as "en" or "de" when telegram knows it
 type User struct {
-	ID        string
-	FirstName string
-	LastName  string
-	Username  string
+	ID           string
+	IsBot        bool
+	FirstName    string
+	LastName     string
+	Username     string
+	LanguageCode string
 }
 
 // FullName returns Firstname + LastName
@@ -65,7 +360,8 @@ const (
 	Channel    ChatType = "channel"
 )
 
-// Chat represents a chat session
+// Chat represents a chat session. ID of outgoing message may also be
+// @username of a channel, see ChatRef.
 type Chat struct {
 	ID       string
 	Type     ChatType
@@ -73,8 +369,116 @@ type Chat struct {
 	Username string
 }
 
-// Plugin is pluggable module to process messages
+// InputPolicy decides what happens when plugin input channel is full
+type InputPolicy int
+
+// Available InputPolicy
+const (
+	// Drop skips the message for the plugin
+	Drop InputPolicy = iota
+	// Block waits until plugin has room for the message
+	Block
+)
+
+// ChatMemberStatus is the role of a user in a chat
+type ChatMemberStatus string
+
+// Available ChatMemberStatus
+const (
+	Creator       ChatMemberStatus = "creator"
+	Administrator ChatMemberStatus = "administrator"
+	Member        ChatMemberStatus = "member"
+	Restricted    ChatMemberStatus = "restricted"
+	Left          ChatMemberStatus = "left"
+	Kicked        ChatMemberStatus = "kicked"
+)
+
+// ChatMember represents membership of a user in a chat
+type ChatMember struct {
+	User   User
+	Status ChatMemberStatus
+}
+
+// IsAdmin reports whether the member is the creator or an administrator
+func (m ChatMember) IsAdmin() bool {
+	return m.Status == Creator || m.Status == Administrator
+}
+
+// ChatPermissions are actions a member is allowed to do in a chat
+type ChatPermissions struct {
+	CanSendMessages       bool
+	CanSendMediaMessages  bool
+	CanSendPolls          bool
+	CanSendOtherMessages  bool
+	CanAddWebPagePreviews bool
+	CanChangeInfo         bool
+	CanInviteUsers        bool
+	CanPinMessages        bool
+}
+
+// AdminRights are rights given to an administrator. CanPostMessages and
+// CanEditMessages only apply to channels.
+type AdminRights struct {
+	IsAnonymous         bool
+	CanManageChat       bool
+	CanDeleteMessages   bool
+	CanManageVideoChats bool
+	CanRestrictMembers  bool
+	CanPromoteMembers   bool
+	CanChangeInfo       bool
+	CanInviteUsers      bool
+	CanPostMessages     bool
+	CanEditMessages     bool
+	CanPinMessages      bool
+}
+
+// InviteLinkOptions limit an invite link created with CreateChatInviteLink.
+// The zero value creates a link that never expires. MemberLimit can't be
+// combined with CreatesJoinRequest, which requires administrators to approve
+// users joining with the link.
+type InviteLinkOptions struct {
+	ExpireDate         time.Time
+	MemberLimit        int
+	CreatesJoinRequest bool
+}
+
+// ChatRef refers to a chat either by its numeric ID or by @username, which
+// telegram accepts for public channels and supergroups
+type ChatRef string
+
+// ChatByID refers to a chat by its numeric ID
+func ChatByID(id int64) ChatRef {
+	return ChatRef(strconv.FormatInt(id, 10))
+}
+
+// ChatByUsername refers to a chat by its username, with or without "@"
+func ChatByUsername(username string) ChatRef {
+	return ChatRef("@" + strings.TrimPrefix(username, "@"))
+}
+
+// IsUsername reports whether the chat is referred by username
+func (c ChatRef) IsUsername() bool {
+	return strings.HasPrefix(string(c), "@")
+}
+
+// Chat returns Chat to address outgoing message to
+func (c ChatRef) Chat() Chat {
+	chat := Chat{ID: string(c)}
+	if c.IsUsername() {
+		chat.Username = strings.TrimPrefix(string(c), "@")
+	}
+	return chat
+}
+
+// Plugin is pluggable module to process messages. Plugin may put Message or
+// PhotoMessage to out channel to reply.
 type Plugin interface {
 	Name() string
-	Init(out chan Message) (chan interface{}, error)
+	Init(out chan interface{}) (chan interface{}, error)
+}
+
+// PluginCloser is implemented by plugin that needs to release resources, Close
+// is called when the plugin is removed or the bot is stopped
+type PluginCloser interface {
+	Close() error
 }
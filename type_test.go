@@ -0,0 +1,41 @@
+package bot
+
+import "testing"
+
+func TestEscapeMarkdownV2(t *testing.T) {
+	// every character telegram documents as reserved in MarkdownV2
+	reserved := "_*[]()~`>#+-=|{}.!\\"
+	for _, r := range reserved {
+		if got, want := EscapeMarkdownV2(string(r)), "\\"+string(r); got != want {
+			t.Errorf("EscapeMarkdownV2(%q) = %q, want %q", r, got, want)
+		}
+	}
+
+	tests := []struct {
+		in, want string
+	}{
+		{"hello world", "hello world"},
+		{"1.5 + 2 = 3.5!", "1\\.5 \\+ 2 \\= 3\\.5\\!"},
+		{"snake_case *bold*", "snake\\_case \\*bold\\*"},
+		{"héllo 🎉 (x)", "héllo 🎉 \\(x\\)"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := EscapeMarkdownV2(tt.in); got != tt.want {
+			t.Errorf("EscapeMarkdownV2(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatParseMode(t *testing.T) {
+	for f, want := range map[MessageFormat]string{Markdown: "Markdown", MarkdownV2: "MarkdownV2", HTML: "HTML"} {
+		out, _ := newTOutMessage(Message{Chat: Chat{ID: "1"}, Text: "x", Format: f})
+		if out.ParseMode != want {
+			t.Errorf("parse_mode of %v = %q, want %q", f, out.ParseMode, want)
+		}
+	}
+	out, _ := newTOutMessage(Message{Chat: Chat{ID: "1"}, Text: "x"})
+	if out.ParseMode != "" {
+		t.Errorf("parse_mode of plain text = %q, want omitted", out.ParseMode)
+	}
+}
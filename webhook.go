@@ -0,0 +1,92 @@
+package bot
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// SetWebhook tells telegram to deliver updates to url instead of being polled
+// with getUpdates
+func (t *Telegram) SetWebhook(url string) error {
+	req := struct {
+		URL string `json:"url"`
+	}{url}
+	if _, err := t.callJSON("setWebhook", req); err != nil {
+		t.log.Error("setWebhook failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// DeleteWebhook removes webhook integration so updates can be polled again
+func (t *Telegram) DeleteWebhook() error {
+	if _, err := t.callJSON("deleteWebhook", struct{}{}); err != nil {
+		t.log.Error("deleteWebhook failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// WebhookHandler returns handler that receives updates pushed by telegram and
+// sends them to the plugins
+func (t *Telegram) WebhookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// telegram.updates.count counts getUpdates requests, not updates
+		t.stats.webhookRequestCount.Inc(1)
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		receivedAt := time.Now()
+		var raw json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+			t.log.Error("decoding webhook update failed", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if t.rawSink != nil {
+			t.rawSink(raw)
+		}
+		var update TUpdate
+		if err := json.Unmarshal(raw, &update); err != nil {
+			t.log.Error("decoding webhook update failed", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		t.dispatchUpdate(update, receivedAt)
+	})
+}
+
+// StartWebhook consumes updates from telegram by listening on addr for
+// requests to path, use it instead of Start after calling SetWebhook. TLS is
+// used when certFile and keyFile are given, otherwise it expects a reverse
+// proxy to terminate TLS. It blocks until Stop is called.
+func (t *Telegram) StartWebhook(addr, path, certFile, keyFile string) error {
+	t.poolOutbox()
+
+	mux := http.NewServeMux()
+	mux.Handle(path, t.WebhookHandler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-t.quit
+		srv.Close()
+	}()
+
+	var err error
+	if certFile != "" && keyFile != "" {
+		err = srv.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
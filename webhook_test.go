@@ -0,0 +1,64 @@
+package bot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestWebhookHandler(t *testing.T) {
+	tg, _ := NewTelegram("123:token")
+	registry := metrics.NewRegistry()
+	tg.SetMetricsRegistry(registry)
+	p := newTestPlugin("p")
+	tg.AddPlugin(p)
+	h := tg.WebhookHandler()
+
+	body := `{"update_id":1,"message":{"message_id":2,"chat":{"id":5,"type":"private"},"from":{"id":5,"first_name":"Ann"},"text":"hello"}}`
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	m, ok := p.next(t).(*Message)
+	if !ok || m.Text != "hello" || m.From.ID != "5" {
+		t.Fatalf("got %#v, want message hello", m)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader("not json")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid body status = %d, want 400", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/hook", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want 405", w.Code)
+	}
+
+	if n := tg.stats.webhookRequestCount.Count(); n != 3 {
+		t.Errorf("telegram.webhook.request = %d, want 3", n)
+	}
+	if n := tg.stats.updateCount.Count(); n != 0 {
+		t.Errorf("telegram.updates.count = %d, want it to count getUpdates only", n)
+	}
+}
+
+func TestSetWebhook(t *testing.T) {
+	api := newAPIRecorder(nil)
+	tg := newTestTelegram(t, api.ServeHTTP)
+
+	if err := tg.SetWebhook("https://example.com/hook"); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.body(t, "setWebhook")["url"]; got != "https://example.com/hook" {
+		t.Errorf("url = %v", got)
+	}
+	if err := tg.DeleteWebhook(); err != nil {
+		t.Fatal(err)
+	}
+	api.body(t, "deleteWebhook")
+}